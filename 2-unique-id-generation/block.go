@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	KV_TIMEOUT = time.Second
+)
+
+// A BlockStore durably records how many counter values a node has reserved
+// so far, so that they are never handed out twice, even across restarts.
+type BlockStore interface {
+	// Reserve durably reserves size more counter values and returns the
+	// first one.
+	Reserve(size int) (int, error)
+}
+
+// FileBlockStore keeps the end of the last reserved block in a local file.
+type FileBlockStore struct {
+	path string
+}
+
+func NewFileBlockStore(path string) *FileBlockStore {
+	return &FileBlockStore{path: path}
+}
+
+func (b *FileBlockStore) Reserve(size int) (int, error) {
+	start := 0
+	data, err := os.ReadFile(b.path)
+	if err == nil {
+		start, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("corrupted block file %v: %w", b.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err := b.write(start + size); err != nil {
+		return 0, err
+	}
+	return start, nil
+}
+
+// write replaces the content of the file atomically: we write a temporary
+// file, fsync it, rename it over the old one and finally fsync the directory,
+// so that after a crash we find either the old or the new value.
+func (b *FileBlockStore) write(end int) error {
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.Itoa(end)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(b.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// KVBlockStore keeps the end of the last reserved block in a key of a
+// maelstrom key-value store.
+type KVBlockStore struct {
+	kv  *maelstrom.KV
+	key string
+}
+
+func NewKVBlockStore(kv *maelstrom.KV, nodeID string) *KVBlockStore {
+	return &KVBlockStore{
+		kv:  kv,
+		key: fmt.Sprintf("block_%v", nodeID),
+	}
+}
+
+func (b *KVBlockStore) Reserve(size int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+
+	start, err := b.kv.ReadInt(ctx, b.key)
+	if err != nil {
+		if rpcErr, ok := err.(*maelstrom.RPCError); !ok || rpcErr.Code != maelstrom.KeyDoesNotExist {
+			return 0, err
+		}
+		start = 0
+	}
+	for {
+		err := b.kv.CompareAndSwap(ctx, b.key, start, start+size, start == 0)
+		if err == nil {
+			return start, nil
+		}
+		// Only this node writes the key, so the CAS can only fail if a
+		// previous incarnation of the node is still around. In that case
+		// we just try again from the new value.
+		if rpcErr, ok := err.(*maelstrom.RPCError); !ok || rpcErr.Code != maelstrom.PreconditionFailed {
+			return 0, err
+		}
+		if start, err = b.kv.ReadInt(ctx, b.key); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// BlockGenerator produces ids of the form <node ID>_<counter> like
+// CounterGenerator, but it only hands out counter values that have been
+// reserved in a BlockStore.
+type BlockGenerator struct {
+	nodeID    string
+	store     BlockStore
+	blockSize int
+
+	next, end int
+	mu        sync.Mutex
+}
+
+func NewBlockGenerator(nodeID string, store BlockStore, blockSize int) *BlockGenerator {
+	return &BlockGenerator{
+		nodeID:    nodeID,
+		store:     store,
+		blockSize: blockSize,
+	}
+}
+
+func (g *BlockGenerator) Generate(count int) ([]any, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]any, 0, count)
+	for len(ids) < count {
+		if g.next == g.end {
+			// Reserve everything we still need at once, so that a large
+			// batch doesn't cost one round trip to the store per block.
+			size := count - len(ids)
+			if size < g.blockSize {
+				size = g.blockSize
+			}
+			start, err := g.store.Reserve(size)
+			if err != nil {
+				return nil, err
+			}
+			g.next, g.end = start, start+size
+		}
+		ids = append(ids, fmt.Sprintf("%v_%d", g.nodeID, g.next))
+		g.next++
+	}
+	return ids, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Snowflake ids can be sent to the clients in different formats, chosen at
+// startup through ID_ENCODING. Every format keeps the timestamp, the node
+// number and the sequence number of the id, so they can all be decoded back.
+const (
+	ENCODING_DECIMAL = "decimal"
+	ENCODING_BASE62  = "base62"
+	ENCODING_ULID    = "ulid"
+	ENCODING_UUIDV7  = "uuidv7"
+)
+
+type Encoding interface {
+	Encode(id int64) string
+	Decode(s string) (int64, error)
+}
+
+func NewEncoding(name string) (Encoding, error) {
+	switch name {
+	case ENCODING_DECIMAL:
+		return DecimalEncoding{}, nil
+	case ENCODING_BASE62:
+		return Base62Encoding{}, nil
+	case ENCODING_ULID:
+		return ULIDEncoding{}, nil
+	case ENCODING_UUIDV7:
+		return UUIDv7Encoding{}, nil
+	default:
+		return nil, fmt.Errorf("unknown ID_ENCODING %q", name)
+	}
+}
+
+// DecimalEncoding is the plain decimal representation of the id.
+type DecimalEncoding struct{}
+
+func (DecimalEncoding) Encode(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func (DecimalEncoding) Decode(s string) (int64, error) {
+	return strconv.ParseInt(s, 10, 64)
+}
+
+const (
+	BASE62_ALPHABET = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// BASE62_LENGTH is the number of digits needed for a 64-bit integer.
+	BASE62_LENGTH = 11
+)
+
+// Base62Encoding writes the id in base 62, padded to a fixed length so that
+// sorting the strings sorts the ids.
+type Base62Encoding struct{}
+
+func (Base62Encoding) Encode(id int64) string {
+	buf := []byte(strings.Repeat("0", BASE62_LENGTH))
+	n := uint64(id)
+	for i := BASE62_LENGTH - 1; n > 0; i-- {
+		buf[i] = BASE62_ALPHABET[n%62]
+		n /= 62
+	}
+	return string(buf)
+}
+
+func (Base62Encoding) Decode(s string) (int64, error) {
+	if len(s) != BASE62_LENGTH {
+		return 0, fmt.Errorf("base62 id %q must be %d characters long", s, BASE62_LENGTH)
+	}
+	var n uint64
+	for _, c := range []byte(s) {
+		digit := strings.IndexByte(BASE62_ALPHABET, c)
+		if digit < 0 {
+			return 0, fmt.Errorf("invalid base62 digit %q in %q", c, s)
+		}
+		if n > (math.MaxInt64-uint64(digit))/62 {
+			return 0, fmt.Errorf("base62 id %q is larger than the largest id", s)
+		}
+		n = n*62 + uint64(digit)
+	}
+	return int64(n), nil
+}
+
+// ULID and UUIDv7 both start with a 48-bit Unix timestamp in milliseconds, so
+// we have to move the snowflake timestamp to the Unix epoch and back.
+func unixMillis(id int64) uint64 {
+	millis := id >> (SNOWFLAKE_NODE_BITS + SNOWFLAKE_SEQUENCE_BITS)
+	return uint64(millis + SNOWFLAKE_EPOCH.UnixMilli())
+}
+
+func composeSnowflake(unixMillis uint64, node, seq uint64) int64 {
+	millis := int64(unixMillis) - SNOWFLAKE_EPOCH.UnixMilli()
+	return millis<<(SNOWFLAKE_NODE_BITS+SNOWFLAKE_SEQUENCE_BITS) |
+		int64(node&SNOWFLAKE_MAX_NODE)<<SNOWFLAKE_SEQUENCE_BITS |
+		int64(seq&SNOWFLAKE_MAX_SEQUENCE)
+}
+
+// decodeSnowflake composes the id decoded from s, and returns an error if one
+// of the fields doesn't fit in a snowflake id, instead of truncating it.
+func decodeSnowflake(s string, unixMillis uint64, node, seq uint64) (int64, error) {
+	epoch := uint64(SNOWFLAKE_EPOCH.UnixMilli())
+	if unixMillis < epoch || unixMillis-epoch > SNOWFLAKE_MAX_MILLIS {
+		return 0, fmt.Errorf("the timestamp of %q is out of the range of snowflake ids", s)
+	}
+	if node > SNOWFLAKE_MAX_NODE || seq > SNOWFLAKE_MAX_SEQUENCE {
+		return 0, fmt.Errorf("the node or sequence number of %q is out of the range of snowflake ids", s)
+	}
+	return composeSnowflake(unixMillis, node, seq), nil
+}
+
+const ULID_ALPHABET = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDEncoding produces a 128-bit ULID written in Crockford's base32. The 80
+// bits after the timestamp contain the node number (16 bits), the sequence
+// number (16 bits) and 48 random bits, so ULIDs from the same millisecond
+// are sorted by node and then by sequence.
+type ULIDEncoding struct{}
+
+func (ULIDEncoding) Encode(id int64) string {
+	_, node, seq := DecomposeSnowflake(id)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], unixMillis(id)<<16|uint64(node))
+	binary.BigEndian.PutUint16(b[8:10], uint16(seq))
+	rand.Read(b[10:16])
+
+	// 128 bits are 26 base32 digits, with 2 spare bits at the top.
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	for i := 25; i >= 0; i-- {
+		out[i] = ULID_ALPHABET[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func (ULIDEncoding) Decode(s string) (int64, error) {
+	if len(s) != 26 {
+		return 0, fmt.Errorf("ULID %q must be 26 characters long", s)
+	}
+	// The first character only carries 3 of the 128 bits.
+	if s[0] > '7' {
+		return 0, fmt.Errorf("ULID %q is larger than 128 bits", s)
+	}
+	var hi, lo uint64
+	for _, c := range []byte(strings.ToUpper(s)) {
+		digit := strings.IndexByte(ULID_ALPHABET, c)
+		if digit < 0 {
+			return 0, fmt.Errorf("invalid ULID character %q in %q", c, s)
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(digit)
+	}
+	return decodeSnowflake(s, hi>>16, hi&0xffff, lo>>48)
+}
+
+// UUIDv7Encoding produces an RFC 9562 version 7 UUID. The 12 bits of rand_a
+// contain the sequence number and rand_b starts with the node number, so
+// UUIDs from the same millisecond are sorted by sequence and then by node.
+type UUIDv7Encoding struct{}
+
+func (UUIDv7Encoding) Encode(id int64) string {
+	_, node, seq := DecomposeSnowflake(id)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], unixMillis(id)<<16|0x7<<12|uint64(seq))
+	rand.Read(b[8:16])
+	binary.BigEndian.PutUint16(b[8:10], 0x2<<14|uint16(node)<<(14-SNOWFLAKE_NODE_BITS)|binary.BigEndian.Uint16(b[8:10])&(1<<(14-SNOWFLAKE_NODE_BITS)-1))
+
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func (UUIDv7Encoding) Decode(s string) (int64, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return 0, fmt.Errorf("invalid UUID %q", s)
+	}
+	if b[6]>>4 != 7 {
+		return 0, fmt.Errorf("UUID %q is not a version 7 UUID", s)
+	}
+	hi := binary.BigEndian.Uint64(b[0:8])
+	// The top 2 bits of rand_b are the variant.
+	node := binary.BigEndian.Uint16(b[8:10]) & (1<<14 - 1) >> (14 - SNOWFLAKE_NODE_BITS)
+	return decodeSnowflake(s, hi>>16, uint64(node), hi&0xfff)
+}
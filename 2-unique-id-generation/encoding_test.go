@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIDs returns snowflake ids that cover the edges of every field.
+func testIDs() []int64 {
+	now := uint64(time.Now().UnixMilli())
+	epoch := uint64(SNOWFLAKE_EPOCH.UnixMilli())
+	return []int64{
+		composeSnowflake(epoch, 0, 0),
+		composeSnowflake(epoch, SNOWFLAKE_MAX_NODE, SNOWFLAKE_MAX_SEQUENCE),
+		composeSnowflake(now, 0, 1),
+		composeSnowflake(now, 1, 0),
+		composeSnowflake(now, 513, 2049),
+		composeSnowflake(now, SNOWFLAKE_MAX_NODE, SNOWFLAKE_MAX_SEQUENCE),
+		composeSnowflake(now+1, 0, 0),
+		composeSnowflake(epoch+SNOWFLAKE_MAX_MILLIS, SNOWFLAKE_MAX_NODE, SNOWFLAKE_MAX_SEQUENCE),
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, name := range []string{ENCODING_DECIMAL, ENCODING_BASE62, ENCODING_ULID, ENCODING_UUIDV7} {
+		encoding, err := NewEncoding(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range testIDs() {
+			s := encoding.Encode(id)
+			decoded, err := encoding.Decode(s)
+			if err != nil {
+				t.Errorf("%v: decoding %q: %v", name, s, err)
+				continue
+			}
+			if decoded != id {
+				t.Errorf("%v: %q decodes to %d, want %d", name, s, decoded, id)
+			}
+		}
+	}
+}
+
+func TestEncodingOrder(t *testing.T) {
+	for _, encoding := range []Encoding{Base62Encoding{}, ULIDEncoding{}} {
+		ids := testIDs()
+		for i := 1; i < len(ids); i++ {
+			a, b := encoding.Encode(ids[i-1]), encoding.Encode(ids[i])
+			if a >= b {
+				t.Errorf("%T: %q (%d) sorts after %q (%d)", encoding, a, ids[i-1], b, ids[i])
+			}
+		}
+	}
+}
+
+func TestULIDDecodeLowercase(t *testing.T) {
+	id := testIDs()[4]
+	s := strings.ToLower(ULIDEncoding{}.Encode(id))
+	decoded, err := ULIDEncoding{}.Decode(s)
+	if err != nil || decoded != id {
+		t.Errorf("%q decodes to %d, %v, want %d", s, decoded, err, id)
+	}
+}
+
+func TestUUIDv7Format(t *testing.T) {
+	s := UUIDv7Encoding{}.Encode(testIDs()[4])
+	if len(s) != 36 || s[14] != '7' || !strings.ContainsRune("89ab", rune(s[19])) {
+		t.Errorf("%q is not a version 7 UUID with the RFC 9562 variant", s)
+	}
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+	tests := []struct {
+		encoding Encoding
+		s        string
+	}{
+		{DecimalEncoding{}, ""},
+		{DecimalEncoding{}, "12a"},
+		{Base62Encoding{}, ""},
+		{Base62Encoding{}, "0000000000"},
+		{Base62Encoding{}, "000000000000"},
+		{Base62Encoding{}, "0000000000-"},
+		// math.MaxInt64 is "AzL8n0Y58m7", and 1<<64 would wrap around to 0.
+		{Base62Encoding{}, "AzL8n0Y58m8"},
+		{Base62Encoding{}, "LygHa16AHYG"},
+		{Base62Encoding{}, "zzzzzzzzzzz"},
+		{ULIDEncoding{}, ""},
+		{ULIDEncoding{}, "01ARZ3NDEKTSV4RRFFQ69G5FA"},
+		{ULIDEncoding{}, "01ARZ3NDEKTSV4RRFFQ69G5FAVX"},
+		// I, L, O and U are not part of Crockford's alphabet.
+		{ULIDEncoding{}, "01ARZ3NDEKTSV4RRFFQ69G5FAU"},
+		{ULIDEncoding{}, "01ARZ3NDEKTSV4RRFFQ69G5FAI"},
+		// Larger than 128 bits.
+		{ULIDEncoding{}, "81KJSHFC00000G018000000000"},
+		{ULIDEncoding{}, "ZZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		// Before SNOWFLAKE_EPOCH, after 41 bits of milliseconds, with
+		// a node number above 1023 and with a sequence number above 4095.
+		{ULIDEncoding{}, "01GNNA1HZZ000G018000000000"},
+		{ULIDEncoding{}, "03GNNA1J00000G018000000000"},
+		{ULIDEncoding{}, "01KJSHFC000Z80018000000000"},
+		{ULIDEncoding{}, "01KJSHFC00000H720000000000"},
+		{UUIDv7Encoding{}, ""},
+		{UUIDv7Encoding{}, "018f0c4e-8a1b-7c2d-9e3f"},
+		{UUIDv7Encoding{}, "018f0c4e-8a1b-7c2d-9e3f-0123456789zz"},
+		{UUIDv7Encoding{}, "018f0c4e-8a1b-7c2d-9e3f-0123456789abcd"},
+		// A version 4 UUID.
+		{UUIDv7Encoding{}, "018f0c4e-8a1b-4c2d-9e3f-0123456789ab"},
+		// Before SNOWFLAKE_EPOCH and after 41 bits of milliseconds.
+		{UUIDv7Encoding{}, "01856aa0-c7ff-7001-8010-000000000000"},
+		{UUIDv7Encoding{}, "03856aa0-c800-7001-8010-000000000000"},
+	}
+	for _, test := range tests {
+		if id, err := test.encoding.Decode(test.s); err == nil {
+			t.Errorf("%T: %q decodes to %d, want an error", test.encoding, test.s, id)
+		}
+	}
+}
+
+func TestNewEncodingUnknown(t *testing.T) {
+	if _, err := NewEncoding("base64"); err == nil {
+		t.Error("NewEncoding accepted an unknown encoding")
+	}
+}
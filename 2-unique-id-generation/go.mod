@@ -2,4 +2,4 @@ module maelstrom-unique-ids
 
 go 1.20
 
-require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20230516124010-52951329816e // indirect
+require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20230516124010-52951329816e
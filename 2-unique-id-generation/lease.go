@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	LEASE_DURATION       = 5 * time.Second
+	LEASE_RENEW_INTERVAL = time.Second
+)
+
+// A Lease lets a node use a snowflake node number (a "worker ID") without
+// relying on its maelstrom node ID, so that nodes can come and go.
+//
+// For every worker ID there is a key worker_<ID> in lin-kv, whose value
+// contains the current owner and the expiration of its lease (in Unix
+// milliseconds). A node claims a free or expired worker ID with a
+// compare-and-swap, and keeps renewing the lease in the same way. While it
+// holds the lease, it only generates ids with timestamps before the
+// expiration, and the next owner starts from the expiration. This means that
+// the two owners can never generate the same id, even if their clocks
+// disagree.
+type Lease struct {
+	kv        *maelstrom.KV
+	owner     string
+	snowflake *Snowflake
+
+	// worker is -1 if we don't hold a lease.
+	worker int64
+	// record is the value we last wrote in the worker key.
+	record string
+}
+
+// NewLease creates a lease for the given node. The owner name contains a
+// random suffix, so that a restarted node doesn't think that it still owns
+// the leases of its previous incarnation.
+func NewLease(kv *maelstrom.KV, nodeID string, snowflake *Snowflake) *Lease {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &Lease{
+		kv:        kv,
+		owner:     fmt.Sprintf("%v-%v", nodeID, hex.EncodeToString(suffix)),
+		snowflake: snowflake,
+		worker:    -1,
+	}
+}
+
+// Run renews the lease, or tries to acquire a new one if we don't have it,
+// every LEASE_RENEW_INTERVAL until done is closed.
+func (l *Lease) Run(done <-chan struct{}) {
+	t := time.NewTicker(LEASE_RENEW_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := l.Refresh(); err != nil {
+				log.Printf("lease: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (l *Lease) Refresh() error {
+	if l.worker < 0 {
+		return l.acquire()
+	}
+	return l.renew()
+}
+
+func (l *Lease) acquire() error {
+	// Start from a different worker ID on every node, so that nodes don't
+	// all compete for the first ones.
+	h := fnv.New32a()
+	h.Write([]byte(l.owner))
+	start := int64(h.Sum32() % (SNOWFLAKE_MAX_NODE + 1))
+
+	for i := int64(0); i <= SNOWFLAKE_MAX_NODE; i++ {
+		worker := (start + i) % (SNOWFLAKE_MAX_NODE + 1)
+		ok, err := l.tryAcquire(worker)
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Printf("lease: acquired worker ID %d", worker)
+			return nil
+		}
+	}
+	return errors.New("no free worker IDs")
+}
+
+func (l *Lease) tryAcquire(worker int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+
+	key := leaseKey(worker)
+	current, exists := "", true
+	var fromMillis int64
+	if err := l.kv.ReadInto(ctx, key, &current); err != nil {
+		if rpcErr, ok := err.(*maelstrom.RPCError); !ok || rpcErr.Code != maelstrom.KeyDoesNotExist {
+			return false, err
+		}
+		exists = false
+	} else {
+		owner, expires, err := parseLeaseRecord(current)
+		if err != nil {
+			return false, err
+		}
+		if owner != l.owner {
+			if expires > time.Now().UnixMilli() {
+				return false, nil
+			}
+			fromMillis = expires
+		}
+	}
+
+	expires := time.Now().Add(LEASE_DURATION).UnixMilli()
+	record := formatLeaseRecord(l.owner, expires)
+	err := l.kv.CompareAndSwap(ctx, key, current, record, !exists)
+	if err != nil {
+		if rpcErr, ok := err.(*maelstrom.RPCError); ok && rpcErr.Code == maelstrom.PreconditionFailed {
+			// Somebody else was faster than us.
+			return false, nil
+		}
+		return false, err
+	}
+
+	l.worker = worker
+	l.record = record
+	l.snowflake.Lease(worker, toSnowflakeMillis(fromMillis), toSnowflakeMillis(expires))
+	return true, nil
+}
+
+func (l *Lease) renew() error {
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+
+	expires := time.Now().Add(LEASE_DURATION).UnixMilli()
+	record := formatLeaseRecord(l.owner, expires)
+	err := l.kv.CompareAndSwap(ctx, leaseKey(l.worker), l.record, record, false)
+	if err == nil {
+		l.record = record
+		l.snowflake.Extend(toSnowflakeMillis(expires))
+		return nil
+	}
+
+	// If the error is a timeout, we keep using the lease until it expires.
+	// Otherwise, somebody else stole the worker ID (or a previous renewal
+	// went through without us knowing it), so we stop generating ids and
+	// look for a new lease on the next tick.
+	if _, ok := err.(*maelstrom.RPCError); !ok {
+		return err
+	}
+	worker := l.worker
+	l.worker = -1
+	l.snowflake.Revoke()
+	return fmt.Errorf("lost worker ID %d: %w", worker, err)
+}
+
+func leaseKey(worker int64) string {
+	return fmt.Sprintf("worker_%d", worker)
+}
+
+func formatLeaseRecord(owner string, expires int64) string {
+	return fmt.Sprintf("%v %d", owner, expires)
+}
+
+func parseLeaseRecord(record string) (string, int64, error) {
+	var owner string
+	var expires int64
+	if _, err := fmt.Sscanf(record, "%s %d", &owner, &expires); err != nil {
+		return "", 0, fmt.Errorf("invalid lease record %q: %w", record, err)
+	}
+	return owner, expires, nil
+}
+
+// toSnowflakeMillis converts Unix milliseconds to milliseconds since
+// SNOWFLAKE_EPOCH.
+func toSnowflakeMillis(unixMillis int64) int64 {
+	if unixMillis == 0 {
+		return 0
+	}
+	return unixMillis - SNOWFLAKE_EPOCH.UnixMilli()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// A snowflake id is a 64-bit integer laid out as follows (from the most
+// significant bit): 1 unused sign bit, 41 bits of milliseconds since
+// SNOWFLAKE_EPOCH, 10 bits of node number and 12 bits of sequence.
+// Sorting the ids numerically sorts them (almost) by creation time.
+const (
+	SNOWFLAKE_NODE_BITS     = 10
+	SNOWFLAKE_SEQUENCE_BITS = 12
+
+	SNOWFLAKE_MAX_MILLIS   = 1<<(63-SNOWFLAKE_NODE_BITS-SNOWFLAKE_SEQUENCE_BITS) - 1
+	SNOWFLAKE_MAX_NODE     = 1<<SNOWFLAKE_NODE_BITS - 1
+	SNOWFLAKE_MAX_SEQUENCE = 1<<SNOWFLAKE_SEQUENCE_BITS - 1
+)
+
+// SNOWFLAKE_EPOCH is 2023-01-01T00:00:00Z, which gives us about 69 years
+// of 41-bit timestamps.
+var SNOWFLAKE_EPOCH = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type Snowflake struct {
+	node     int64
+	encoding Encoding
+
+	// If the node number comes from a Lease, the generator can only use
+	// timestamps before expiresMillis. When there is no lease, expiresMillis
+	// is 0 and no ids can be generated.
+	leased        bool
+	expiresMillis int64
+
+	lastMillis int64
+	seq        int64
+	mu         sync.Mutex
+}
+
+func NewSnowflake(node int64, encoding Encoding) (*Snowflake, error) {
+	if node < 0 || node > SNOWFLAKE_MAX_NODE {
+		return nil, fmt.Errorf("snowflake node number %d out of range [0, %d]", node, SNOWFLAKE_MAX_NODE)
+	}
+	return &Snowflake{
+		node:     node,
+		encoding: encoding,
+	}, nil
+}
+
+// NewLeasedSnowflake creates a generator that doesn't produce any id until
+// its node number is set through Lease.
+func NewLeasedSnowflake(encoding Encoding) *Snowflake {
+	return &Snowflake{
+		leased:   true,
+		encoding: encoding,
+	}
+}
+
+// Lease sets the node number of the generator, and makes it use timestamps
+// in [fromMillis, expiresMillis) only. The previous holder of the node number
+// only used timestamps before fromMillis, so our ids can't collide with its
+// ids, whatever the clocks of the two nodes say.
+func (g *Snowflake) Lease(node, fromMillis, expiresMillis int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.node = node
+	g.expiresMillis = expiresMillis
+	if g.lastMillis < fromMillis {
+		// Pretend that we have exhausted the millisecond right before
+		// fromMillis, so that the next id uses fromMillis or later.
+		g.lastMillis = fromMillis - 1
+		g.seq = SNOWFLAKE_MAX_SEQUENCE
+	}
+}
+
+// Extend moves the end of the current lease.
+func (g *Snowflake) Extend(expiresMillis int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expiresMillis = expiresMillis
+}
+
+// Revoke stops the generator until the next call to Lease.
+func (g *Snowflake) Revoke() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expiresMillis = 0
+}
+
+// NodeNumber extracts the numeric part of a maelstrom node ID, so "n3"
+// becomes 3.
+func NodeNumber(id string) (int64, error) {
+	number, err := strconv.ParseInt(strings.TrimPrefix(id, "n"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("node ID %q is not of the form n<number>", id)
+	}
+	return number, nil
+}
+
+// Generate always returns the ids as strings, even with the decimal encoding:
+// maelstrom's Reply goes through a map[string]any, which would round a 64-bit
+// integer to a float64.
+func (g *Snowflake) Generate(count int) ([]any, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]any, count)
+	for i := range ids {
+		id := g.next()
+		if g.leased && g.lastMillis >= g.expiresMillis {
+			return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "no valid node number lease")
+		}
+		ids[i] = g.encoding.Encode(id)
+	}
+	return ids, nil
+}
+
+// next must be called with g.mu held.
+func (g *Snowflake) next() int64 {
+	now := snowflakeMillis()
+	if now > g.lastMillis {
+		g.lastMillis = now
+		g.seq = 0
+	} else {
+		// Either we are still in the same millisecond, or the clock went
+		// backwards. In both cases we keep using the last timestamp, so
+		// that the ids never go back in time and never repeat.
+		if now < g.lastMillis {
+			log.Printf("clock moved backwards by %dms, reusing last timestamp", g.lastMillis-now)
+		}
+		g.seq++
+		if g.seq > SNOWFLAKE_MAX_SEQUENCE {
+			g.lastMillis = g.waitNextMillis()
+			g.seq = 0
+		}
+	}
+	return g.lastMillis<<(SNOWFLAKE_NODE_BITS+SNOWFLAKE_SEQUENCE_BITS) |
+		g.node<<SNOWFLAKE_SEQUENCE_BITS |
+		g.seq
+}
+
+// waitNextMillis is called when the sequence numbers for g.lastMillis are
+// exhausted. If the clock is behind g.lastMillis we don't want to wait for
+// it to catch up, so we simply borrow the next millisecond.
+func (g *Snowflake) waitNextMillis() int64 {
+	for {
+		now := snowflakeMillis()
+		if now > g.lastMillis {
+			return now
+		}
+		if now < g.lastMillis {
+			return g.lastMillis + 1
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// DecomposeSnowflake splits an id back into its timestamp, node number and
+// sequence number.
+func DecomposeSnowflake(id int64) (time.Time, int64, int64) {
+	millis := id >> (SNOWFLAKE_NODE_BITS + SNOWFLAKE_SEQUENCE_BITS)
+	node := id >> SNOWFLAKE_SEQUENCE_BITS & SNOWFLAKE_MAX_NODE
+	seq := id & SNOWFLAKE_MAX_SEQUENCE
+	return SNOWFLAKE_EPOCH.Add(time.Duration(millis) * time.Millisecond), node, seq
+}
+
+// snowflakeMillis is a variable so that the tests can control the clock.
+var snowflakeMillis = func() int64 {
+	return time.Since(SNOWFLAKE_EPOCH).Milliseconds()
+}
@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+
+// fakeClock makes snowflakeMillis return the values of clock until the end of
+// the test.
+func fakeClock(t *testing.T, clock func() int64) {
+	saved := snowflakeMillis
+	snowflakeMillis = clock
+	t.Cleanup(func() { snowflakeMillis = saved })
+}
+
+// generate returns the decomposed ids, with the timestamps in milliseconds
+// since SNOWFLAKE_EPOCH.
+func generate(t *testing.T, g *Snowflake, count int) (millis, nodes, seqs []int64) {
+	t.Helper()
+	ids, err := g.Generate(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range ids {
+		id, err := DecimalEncoding{}.Decode(s.(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, node, seq := DecomposeSnowflake(id)
+		millis = append(millis, ts.Sub(SNOWFLAKE_EPOCH).Milliseconds())
+		nodes = append(nodes, node)
+		seqs = append(seqs, seq)
+	}
+	return millis, nodes, seqs
+}
+
+func TestSnowflakeClockBackwards(t *testing.T) {
+	now := int64(1000)
+	fakeClock(t, func() int64 { return now })
+	g, err := NewSnowflake(7, DecimalEncoding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generate(t, g, 3)
+	now = 400
+	millis, nodes, seqs := generate(t, g, 2)
+	for i := range millis {
+		if millis[i] != 1000 || nodes[i] != 7 || seqs[i] != int64(3+i) {
+			t.Errorf("id %d after the clock went back is (%d, %d, %d), want (1000, 7, %d)", i, millis[i], nodes[i], seqs[i], 3+i)
+		}
+	}
+	now = 1001
+	if millis, _, seqs := generate(t, g, 1); millis[0] != 1001 || seqs[0] != 0 {
+		t.Errorf("id after the clock caught up is (%d, %d), want (1001, 0)", millis[0], seqs[0])
+	}
+}
+
+func TestSnowflakeFullMillisecond(t *testing.T) {
+	calls := 0
+	fakeClock(t, func() int64 {
+		calls++
+		if calls > SNOWFLAKE_MAX_SEQUENCE+2 {
+			return 2000
+		}
+		return 1000
+	})
+	g, err := NewSnowflake(1, DecimalEncoding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	millis, _, seqs := generate(t, g, SNOWFLAKE_MAX_SEQUENCE+2)
+	for i := 0; i <= SNOWFLAKE_MAX_SEQUENCE; i++ {
+		if millis[i] != 1000 || seqs[i] != int64(i) {
+			t.Fatalf("id %d is (%d, %d), want (1000, %d)", i, millis[i], seqs[i], i)
+		}
+	}
+	if last := len(millis) - 1; millis[last] != 2000 || seqs[last] != 0 {
+		t.Errorf("id after a full millisecond is (%d, %d), want (2000, 0)", millis[last], seqs[last])
+	}
+
+	// With the clock behind, the generator borrows the next millisecond
+	// instead of waiting.
+	calls = -1 << 30
+	millis, _, seqs = generate(t, g, SNOWFLAKE_MAX_SEQUENCE+1)
+	if last := len(millis) - 1; millis[last] != 2001 || seqs[last] != 0 {
+		t.Errorf("id after a full millisecond with the clock behind is (%d, %d), want (2001, 0)", millis[last], seqs[last])
+	}
+}
+
+func TestSnowflakeLease(t *testing.T) {
+	now := int64(1000)
+	fakeClock(t, func() int64 { return now })
+	g := NewLeasedSnowflake(DecimalEncoding{})
+	if ids, err := g.Generate(1); err == nil {
+		t.Fatalf("generated %v without a lease", ids)
+	}
+
+	g.Lease(5, 1010, 1012)
+	millis, nodes, seqs := generate(t, g, 1)
+	if millis[0] != 1010 || nodes[0] != 5 || seqs[0] != 0 {
+		t.Errorf("first id of the lease is (%d, %d, %d), want (1010, 5, 0)", millis[0], nodes[0], seqs[0])
+	}
+	now = 1011
+	generate(t, g, SNOWFLAKE_MAX_SEQUENCE+1)
+
+	// The next id would borrow millisecond 1012, where the lease expires.
+	now = 1005
+	if ids, err := g.Generate(1); err == nil {
+		t.Errorf("generated %v at the end of the lease", ids)
+	}
+	now = 1012
+	if ids, err := g.Generate(1); err == nil {
+		t.Errorf("generated %v after the lease expired", ids)
+	}
+
+	g.Extend(1013)
+	if millis, _, _ := generate(t, g, 1); millis[0] != 1012 {
+		t.Errorf("id after extending the lease uses millisecond %d, want 1012", millis[0])
+	}
+	g.Revoke()
+	if ids, err := g.Generate(1); err == nil {
+		t.Errorf("generated %v after the lease was revoked", ids)
+	}
+}
@@ -4,29 +4,202 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+// The generation strategy is chosen at startup through environment
+// variables, since maelstrom doesn't let us pass arguments to the binary.
+const (
+	MODE_COUNTER   = "counter"
+	MODE_SNOWFLAKE = "snowflake"
+	MODE_BLOCK     = "block"
+
+	BLOCK_STORE_FILE  = "file"
+	BLOCK_STORE_LINKV = "lin-kv"
+
+	DEFAULT_BLOCK_SIZE = 1000
+
+	NODE_NUMBERS_STATIC = "static"
+	NODE_NUMBERS_LEASE  = "lease"
+
+	MAX_BATCH_SIZE = 10000
+)
+
+type Config struct {
+	// Mode is one of the MODE_* constants (ID_MODE).
+	Mode string
+	// BlockStore is one of the BLOCK_STORE_* constants (ID_BLOCK_STORE).
+	BlockStore string
+	// BlockSize is the number of counter values reserved at a time
+	// (ID_BLOCK_SIZE).
+	BlockSize int
+	// BlockDir is the directory of the block files (ID_BLOCK_DIR).
+	BlockDir string
+	// Encoding is one of the ENCODING_* constants (ID_ENCODING). It can only
+	// be changed in snowflake mode.
+	Encoding string
+	// NodeNumbers is one of the NODE_NUMBERS_* constants (ID_NODE_NUMBERS),
+	// and tells where snowflake node numbers come from: the maelstrom node
+	// ID or a lease in lin-kv.
+	NodeNumbers string
+}
+
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Mode:        MODE_COUNTER,
+		BlockStore:  BLOCK_STORE_FILE,
+		BlockSize:   DEFAULT_BLOCK_SIZE,
+		BlockDir:    ".",
+		Encoding:    ENCODING_DECIMAL,
+		NodeNumbers: NODE_NUMBERS_STATIC,
+	}
+	if mode := os.Getenv("ID_MODE"); mode != "" {
+		config.Mode = mode
+	}
+	if store := os.Getenv("ID_BLOCK_STORE"); store != "" {
+		config.BlockStore = store
+	}
+	if size := os.Getenv("ID_BLOCK_SIZE"); size != "" {
+		var err error
+		config.BlockSize, err = strconv.Atoi(size)
+		if err != nil || config.BlockSize <= 0 {
+			return config, fmt.Errorf("invalid ID_BLOCK_SIZE %q", size)
+		}
+	}
+	if dir := os.Getenv("ID_BLOCK_DIR"); dir != "" {
+		config.BlockDir = dir
+	}
+	if encoding := os.Getenv("ID_ENCODING"); encoding != "" {
+		if config.Mode != MODE_SNOWFLAKE {
+			return config, fmt.Errorf("ID_ENCODING requires ID_MODE=%v", MODE_SNOWFLAKE)
+		}
+		config.Encoding = encoding
+	}
+	if nodeNumbers := os.Getenv("ID_NODE_NUMBERS"); nodeNumbers != "" {
+		if config.Mode != MODE_SNOWFLAKE {
+			return config, fmt.Errorf("ID_NODE_NUMBERS requires ID_MODE=%v", MODE_SNOWFLAKE)
+		}
+		config.NodeNumbers = nodeNumbers
+	}
+	return config, nil
+}
+
+type IdGenerator interface {
+	// Generate returns count new ids. They are allocated under a single
+	// lock acquisition, so they are contiguous whenever possible.
+	Generate(count int) ([]any, error)
+}
+
+// CounterGenerator produces ids of the form <node ID>_<counter>. It is only
+// safe as long as the node is never restarted.
+type CounterGenerator struct {
+	nodeID string
+
+	counter   int
+	counterMu sync.Mutex
+}
+
+func (g *CounterGenerator) Generate(count int) ([]any, error) {
+	g.counterMu.Lock()
+	defer g.counterMu.Unlock()
+	ids := make([]any, count)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%v_%d", g.nodeID, g.counter)
+		g.counter++
+	}
+	return ids, nil
+}
+
 type Server struct {
 	n *maelstrom.Node
 
-	counter int
+	config    Config
+	generator IdGenerator
+	encoding  Encoding
+
+	// done is closed when the node stops, to stop the lease renewals.
+	done chan struct{}
 }
 
-func NewServer() *Server {
+func NewServer(config Config) *Server {
 	return &Server{
-		n: maelstrom.NewNode(),
+		n:      maelstrom.NewNode(),
+		config: config,
+		done:   make(chan struct{}),
+	}
+}
+
+// handleInit builds the generator, since we need to know our node ID first.
+// Maelstrom doesn't send any other message before init_ok, so there's no
+// need to protect s.generator with a lock.
+func (s *Server) handleInit(msg maelstrom.Message) error {
+	switch s.config.Mode {
+	case MODE_COUNTER:
+		s.generator = &CounterGenerator{nodeID: s.n.ID()}
+	case MODE_SNOWFLAKE:
+		var err error
+		s.encoding, err = NewEncoding(s.config.Encoding)
+		if err != nil {
+			return err
+		}
+		switch s.config.NodeNumbers {
+		case NODE_NUMBERS_STATIC:
+			node, err := NodeNumber(s.n.ID())
+			if err != nil {
+				return err
+			}
+			s.generator, err = NewSnowflake(node, s.encoding)
+			if err != nil {
+				return err
+			}
+		case NODE_NUMBERS_LEASE:
+			snowflake := NewLeasedSnowflake(s.encoding)
+			lease := NewLease(maelstrom.NewLinKV(s.n), s.n.ID(), snowflake)
+			// If we can't get a lease right away, we keep trying in the
+			// background and refuse to generate ids in the meantime.
+			if err := lease.Refresh(); err != nil {
+				log.Printf("lease: %v", err)
+			}
+			go lease.Run(s.done)
+			s.generator = snowflake
+		default:
+			return fmt.Errorf("unknown ID_NODE_NUMBERS %q", s.config.NodeNumbers)
+		}
+	case MODE_BLOCK:
+		var store BlockStore
+		switch s.config.BlockStore {
+		case BLOCK_STORE_FILE:
+			path := filepath.Join(s.config.BlockDir, fmt.Sprintf("%v.block", s.n.ID()))
+			store = NewFileBlockStore(path)
+		case BLOCK_STORE_LINKV:
+			store = NewKVBlockStore(maelstrom.NewLinKV(s.n), s.n.ID())
+		default:
+			return fmt.Errorf("unknown ID_BLOCK_STORE %q", s.config.BlockStore)
+		}
+		s.generator = NewBlockGenerator(s.n.ID(), store, s.config.BlockSize)
+	default:
+		return fmt.Errorf("unknown ID_MODE %q", s.config.Mode)
 	}
+	return nil
 }
 
+// If Count is set, the response contains Count ids in Ids instead of a
+// single one in Id.
 type GenerateInput struct {
-	Type string `json:"type"`
+	Type  string `json:"type"`
+	Count int    `json:"count,omitempty"`
 }
 
 type GenerateOutput struct {
 	Type string `json:"type"`
-	Id   string `json:"id"`
+	Id   any    `json:"id,omitempty"`
+	Ids  []any  `json:"ids,omitempty"`
 }
 
 func (s *Server) handleGenerate(msg maelstrom.Message) error {
@@ -35,21 +208,82 @@ func (s *Server) handleGenerate(msg maelstrom.Message) error {
 		return err
 	}
 
+	if inputBody.Count < 0 || inputBody.Count > MAX_BATCH_SIZE {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("count must be between 1 and %d", MAX_BATCH_SIZE))
+	}
+
+	count := inputBody.Count
+	if count == 0 {
+		count = 1
+	}
+	ids, err := s.generator.Generate(count)
+	if err != nil {
+		return err
+	}
+
 	outputBody := GenerateOutput{
 		Type: "generate_ok",
-		Id:   fmt.Sprintf("%v_%d", s.n.ID(), s.counter),
 	}
-	s.counter++
+	if inputBody.Count == 0 {
+		outputBody.Id = ids[0]
+	} else {
+		outputBody.Ids = ids
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+type DecodeInput struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type DecodeOutput struct {
+	Type      string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	Node      int64  `json:"node"`
+	Seq       int64  `json:"seq"`
+}
+
+// handleDecode is a debugging helper that tells which node generated a
+// snowflake id, and when.
+func (s *Server) handleDecode(msg maelstrom.Message) error {
+	var inputBody DecodeInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	if s.encoding == nil {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "only snowflake ids can be decoded")
+	}
+
+	id, err := s.encoding.Decode(inputBody.Id)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	timestamp, node, seq := DecomposeSnowflake(id)
 
+	outputBody := DecodeOutput{
+		Type:      "decode_ok",
+		Timestamp: timestamp.Format(time.RFC3339Nano),
+		Node:      node,
+		Seq:       seq,
+	}
 	return s.n.Reply(msg, outputBody)
 }
 
 func main() {
-	s := NewServer()
+	config, err := ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := NewServer(config)
 
+	s.n.Handle("init", s.handleInit)
 	s.n.Handle("generate", s.handleGenerate)
+	s.n.Handle("decode", s.handleDecode)
 
-	if err := s.n.Run(); err != nil {
+	err = s.n.Run()
+	close(s.done)
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,5 +0,0 @@
-module maelstrom-fault-tolerant-broadcast
-
-go 1.20
-
-require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20230516124010-52951329816e // indirect
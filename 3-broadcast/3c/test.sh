@@ -2,5 +2,5 @@
 
 SCRIPT_DIR=$(pwd)/bin
 mkdir -p $SCRIPT_DIR
-go build -o $SCRIPT_DIR/main
-"$MAELSTROM_PATH/maelstrom" test -w broadcast --bin $SCRIPT_DIR/main --node-count 5 --time-limit 20 --rate 10 --nemesis partition
+(cd ../broadcast && go build -o $SCRIPT_DIR/main)
+BROADCAST_STRATEGY=topology "$MAELSTROM_PATH/maelstrom" test -w broadcast --bin $SCRIPT_DIR/main --node-count 5 --time-limit 20 --rate 10 --nemesis partition
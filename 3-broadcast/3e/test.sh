@@ -2,5 +2,5 @@
 
 SCRIPT_DIR=$(pwd)/bin
 mkdir -p $SCRIPT_DIR
-go build -o $SCRIPT_DIR/main
-"$MAELSTROM_PATH/maelstrom" test -w broadcast --bin $SCRIPT_DIR/main --node-count 25 --time-limit 20 --rate 100 --latency 100
+(cd ../broadcast && go build -o $SCRIPT_DIR/main)
+BROADCAST_STRATEGY=star BROADCAST_SYNC_TIMEOUT=150ms "$MAELSTROM_PATH/maelstrom" test -w broadcast --bin $SCRIPT_DIR/main --node-count 25 --time-limit 20 --rate 100 --latency 100
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	DEFAULT_SYNC_TIMEOUT     = 200 * time.Millisecond
+	DEFAULT_MAX_SYNC_TIMEOUT = time.Second
+	DEFAULT_BATCH_SIZE       = 100
+	DEFAULT_SYNC_RPC_TIMEOUT = time.Second
+	DEFAULT_PING_TIMEOUT     = 300 * time.Millisecond
+)
+
+// Config contains the settings of the server, which ConfigFromEnv reads from
+// the BROADCAST_* environment variables, in the same way as the unique ids
+// challenge chooses its mode.
+type Config struct {
+	// Strategy is one of the STRATEGY_* constants (BROADCAST_STRATEGY).
+	Strategy string
+	// SyncTimeout is the interval between two sync rounds when there are
+	// new messages (BROADCAST_SYNC_TIMEOUT, as a Go duration). Smaller
+	// values mean lower latency but more messages per operation.
+	SyncTimeout time.Duration
+	// MaxSyncTimeout is the interval that we back off to when there are no
+	// new messages (BROADCAST_MAX_SYNC_TIMEOUT, as a Go duration).
+	MaxSyncTimeout time.Duration
+	// SyncRPCTimeout is how long we wait for the sync_ok of a neighbor
+	// before we consider the sync lost and send another one
+	// (BROADCAST_SYNC_RPC_TIMEOUT, as a Go duration).
+	SyncRPCTimeout time.Duration
+	// PingTimeout is how long the swim strategy waits for the reply to a
+	// ping (BROADCAST_PING_TIMEOUT, as a Go duration). It must be longer
+	// than a round trip between two nodes.
+	PingTimeout time.Duration
+	// BatchSize is the number of new messages after which we sync without
+	// waiting for the end of the interval (BROADCAST_BATCH_SIZE).
+	BatchSize int
+	// ClusterSize is the size of the clusters in the clusters strategy
+	// (BROADCAST_CLUSTER_SIZE).
+	ClusterSize int
+	// MaxPayloadSize is the maximum size of a message in bytes, in its
+	// canonical JSON encoding (BROADCAST_MAX_PAYLOAD_SIZE).
+	MaxPayloadSize int
+	// MaxSyncSize is the maximum size in bytes of the messages carried by a
+	// single sync rpc: if a neighbor needs more, we split them in several
+	// syncs (BROADCAST_MAX_SYNC_SIZE). It is never smaller than
+	// MaxPayloadSize.
+	MaxSyncSize int
+	// Order is one of the ORDER_* constants (BROADCAST_ORDER), and decides
+	// the order in which read returns the messages.
+	Order string
+	// MessageTTL is how long a message lives if the client doesn't choose,
+	// or 0 if messages never expire (BROADCAST_MESSAGE_TTL, as a Go
+	// duration).
+	MessageTTL time.Duration
+	// GC enables the garbage collector (BROADCAST_GC).
+	GC bool
+	// StoreDir is the directory where the node persists its state, or ""
+	// to keep everything in memory (BROADCAST_STORE_DIR).
+	StoreDir string
+	// Eager makes the server push every new message to its neighbors as soon
+	// as it receives it, and leaves the sync rounds to repair lost pushes
+	// (BROADCAST_EAGER). It is always on with the plumtree strategy.
+	Eager bool
+	// Signed makes every origin sign its messages, and every node drop the
+	// messages with an invalid signature (BROADCAST_SIGNED).
+	Signed bool
+	// Encoding is one of the ENCODING_* constants (BROADCAST_ENCODING), and
+	// decides how the syncs carry the messages to the neighbors that support
+	// it.
+	Encoding string
+	// Regions is the number of regions that the nodes are split into, or 1
+	// to ignore where the nodes are (BROADCAST_REGIONS). With more regions,
+	// the overlay has a single link between every pair of regions.
+	Regions int
+}
+
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Strategy:       STRATEGY_TOPOLOGY,
+		SyncTimeout:    DEFAULT_SYNC_TIMEOUT,
+		MaxSyncTimeout: DEFAULT_MAX_SYNC_TIMEOUT,
+		SyncRPCTimeout: DEFAULT_SYNC_RPC_TIMEOUT,
+		PingTimeout:    DEFAULT_PING_TIMEOUT,
+		BatchSize:      DEFAULT_BATCH_SIZE,
+		ClusterSize:    DEFAULT_CLUSTER_SIZE,
+		MaxPayloadSize: DEFAULT_MAX_PAYLOAD_SIZE,
+		MaxSyncSize:    DEFAULT_MAX_SYNC_SIZE,
+		Order:          ORDER_NONE,
+		Encoding:       ENCODING_JSON,
+		Regions:        1,
+	}
+	if strategy := os.Getenv("BROADCAST_STRATEGY"); strategy != "" {
+		config.Strategy = strategy
+	}
+	config.StoreDir = os.Getenv("BROADCAST_STORE_DIR")
+	if order := os.Getenv("BROADCAST_ORDER"); order != "" {
+		if order != ORDER_NONE && order != ORDER_FIFO && order != ORDER_TOTAL {
+			return config, fmt.Errorf("invalid BROADCAST_ORDER %q", order)
+		}
+		config.Order = order
+	}
+	if encoding := os.Getenv("BROADCAST_ENCODING"); encoding != "" {
+		if encoding != ENCODING_JSON && encoding != ENCODING_DELTA {
+			return config, fmt.Errorf("invalid BROADCAST_ENCODING %q", encoding)
+		}
+		config.Encoding = encoding
+	}
+	if err := durationFromEnv("BROADCAST_SYNC_TIMEOUT", &config.SyncTimeout); err != nil {
+		return config, err
+	}
+	if err := durationFromEnv("BROADCAST_MAX_SYNC_TIMEOUT", &config.MaxSyncTimeout); err != nil {
+		return config, err
+	}
+	if config.MaxSyncTimeout < config.SyncTimeout {
+		config.MaxSyncTimeout = config.SyncTimeout
+	}
+	if err := durationFromEnv("BROADCAST_SYNC_RPC_TIMEOUT", &config.SyncRPCTimeout); err != nil {
+		return config, err
+	}
+	if err := durationFromEnv("BROADCAST_PING_TIMEOUT", &config.PingTimeout); err != nil {
+		return config, err
+	}
+	if err := intFromEnv("BROADCAST_BATCH_SIZE", &config.BatchSize); err != nil {
+		return config, err
+	}
+	if err := intFromEnv("BROADCAST_CLUSTER_SIZE", &config.ClusterSize); err != nil {
+		return config, err
+	}
+	if err := intFromEnv("BROADCAST_MAX_PAYLOAD_SIZE", &config.MaxPayloadSize); err != nil {
+		return config, err
+	}
+	if err := intFromEnv("BROADCAST_MAX_SYNC_SIZE", &config.MaxSyncSize); err != nil {
+		return config, err
+	}
+	if config.MaxSyncSize < config.MaxPayloadSize {
+		config.MaxSyncSize = config.MaxPayloadSize
+	}
+	if err := durationFromEnv("BROADCAST_MESSAGE_TTL", &config.MessageTTL); err != nil {
+		return config, err
+	}
+	if err := boolFromEnv("BROADCAST_GC", &config.GC); err != nil {
+		return config, err
+	}
+	if err := boolFromEnv("BROADCAST_EAGER", &config.Eager); err != nil {
+		return config, err
+	}
+	if err := boolFromEnv("BROADCAST_SIGNED", &config.Signed); err != nil {
+		return config, err
+	}
+	if config.Strategy == STRATEGY_PLUMTREE {
+		config.Eager = true
+	}
+	if err := intFromEnv("BROADCAST_REGIONS", &config.Regions); err != nil {
+		return config, err
+	}
+	// These strategies keep their own state about the overlay, which the
+	// regions would hide from the server.
+	if config.Regions > 1 && (config.Strategy == STRATEGY_CLUSTERS || config.Strategy == STRATEGY_SWIM || config.Strategy == STRATEGY_PLUMTREE) {
+		return config, fmt.Errorf("BROADCAST_REGIONS is not supported with the %v strategy", config.Strategy)
+	}
+	return config, nil
+}
+
+func durationFromEnv(name string, d *time.Duration) error {
+	if value := os.Getenv(name); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid %v %q", name, value)
+		}
+		*d = parsed
+	}
+	return nil
+}
+
+func boolFromEnv(name string, b *bool) error {
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %v %q", name, value)
+		}
+		*b = parsed
+	}
+	return nil
+}
+
+func intFromEnv(name string, n *int) error {
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid %v %q", name, value)
+		}
+		*n = parsed
+	}
+	return nil
+}
+
+type Server struct {
+	n        *maelstrom.Node
+	kv       *maelstrom.KV
+	config   Config
+	strategy Strategy
+	// incarnation distinguishes the cursors created before and after a
+	// restart.
+	incarnation string
+	// epoch is our epoch, which is always 0 if we persist our state, and
+	// origin the origin of the messages that we receive from clients.
+	epoch  int
+	origin string
+	// storage is nil if the state is only kept in memory. unsaved is the
+	// number of records appended after the last snapshot.
+	storage Storage
+	unsaved atomic.Int64
+	done    chan struct{}
+	// In signed mode, key is our private key, keys contains the public keys
+	// of the origins that we read from lin-kv, and rejected counts the messages that we
+	// dropped because of an invalid signature.
+	key      ed25519.PrivateKey
+	keys     map[string]ed25519.PublicKey
+	keysMu   sync.Mutex
+	rejected atomic.Int64
+	// crossRegion counts the syncs and pushes that we sent to other
+	// regions.
+	crossRegion atomic.Int64
+
+	// membership contains the nodes of the overlay, and topology the one
+	// proposed by maelstrom. We compute our neighbors from both.
+	membership Membership
+	topology   map[string][]string
+	neighbors  []string
+	// neighborsAcks contains, for each neighbor, the version vector that
+	// it last sent us, so we know which messages it still needs. In eager
+	// mode we also advance it when we push a message to the neighbor.
+	neighborsAcks map[string]VersionVector
+	// lastSeen contains the last time we received a sync or a sync_ok from
+	// each neighbor, and lastProbe the last time we sent an empty sync to a
+	// neighbor that we suspect. detectors, suspected and detours are used
+	// to route around the neighbors that seem to be dead.
+	lastSeen  map[string]time.Time
+	lastProbe map[string]time.Time
+	detectors map[string]*PhiDetector
+	suspected map[string]bool
+	detours   map[string][]string
+	// sentPromises contains, for each neighbor, the value of promisesVersion
+	// when we last sent it our promises, sentMembership the version of the
+	// last membership that we sent it, and sentVersions the value of
+	// versionsClock when we last sent it the versions.
+	sentPromises   map[string]int
+	sentMembership map[string]int
+	sentVersions   map[string]int
+	// packed contains the neighbors that understand the delta encoding.
+	packed map[string]bool
+	// inFlight contains, for every neighbor, the sync that it hasn't
+	// answered yet, and lastSyncID is the id of the last sync that we sent.
+	inFlight   map[string]syncInFlight
+	lastSyncID int
+	// pings contains, for every member that the swim strategy is pinging,
+	// the last ping that we sent it.
+	pings       map[string]*pendingPing
+	neighborsMu sync.RWMutex
+
+	// msgs contains all the distinct messages that we delivered, in
+	// delivery order, and logs all the messages we know grouped by origin.
+	// seq is the last sequence number we assigned to a message received
+	// from a client.
+	msgs *PayloadSet
+	logs map[string]*OriginLog
+	seq  int
+	// For the total order, clock is our Lamport clock, promises contains the
+	// last promise of every node, and undelivered the messages that are not
+	// stable yet. promisesVersion changes every time promises changes.
+	clock           int
+	promises        map[string]Promise
+	promisesVersion int
+	undelivered     undeliveredHeap
+	// versions contains the last version vector that we know for every
+	// node, for the garbage collector, and versionsClock counts the times
+	// that we merged the versions of another node.
+	versions      map[string]*NodeVersion
+	versionsClock int
+	// members is a copy of membership.Members, which we can use while
+	// holding only msgsMu.
+	members []string
+	// pending is the number of new messages since the last sync round.
+	pending int
+	msgsMu  sync.RWMutex
+
+	// newMsgs wakes up the sync loop when there are new messages.
+	newMsgs chan struct{}
+}
+
+func NewServer(config Config, strategy Strategy) *Server {
+	n := maelstrom.NewNode()
+	return &Server{
+		n:              n,
+		kv:             maelstrom.NewLinKV(n),
+		config:         config,
+		strategy:       strategy,
+		incarnation:    newIncarnation(),
+		keys:           make(map[string]ed25519.PublicKey),
+		msgs:           NewPayloadSet(),
+		logs:           make(map[string]*OriginLog),
+		neighborsAcks:  make(map[string]VersionVector),
+		lastSeen:       make(map[string]time.Time),
+		lastProbe:      make(map[string]time.Time),
+		detectors:      make(map[string]*PhiDetector),
+		suspected:      make(map[string]bool),
+		detours:        make(map[string][]string),
+		sentPromises:   make(map[string]int),
+		sentMembership: make(map[string]int),
+		sentVersions:   make(map[string]int),
+		packed:         make(map[string]bool),
+		inFlight:       make(map[string]syncInFlight),
+		pings:          make(map[string]*pendingPing),
+		promises:       make(map[string]Promise),
+		versions:       make(map[string]*NodeVersion),
+		newMsgs:        make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+}
+
+// initHandler sets the initial membership, restores the state saved by a
+// previous incarnation of the node, if any, and publishes our public key in
+// signed mode. It runs before we reply to the init message, so we don't
+// receive other messages in the meantime.
+func (s *Server) initHandler(msg maelstrom.Message) error {
+	s.neighborsMu.Lock()
+	s.membership = Membership{Members: s.n.NodeIDs()}
+	s.neighborsMu.Unlock()
+	s.msgsMu.Lock()
+	s.members = s.n.NodeIDs()
+	s.msgsMu.Unlock()
+
+	s.origin = s.n.ID()
+	if s.config.StoreDir != "" {
+		storage, err := NewFileStorage(s.config.StoreDir, s.n.ID())
+		if err != nil {
+			return err
+		}
+		if err := s.restore(storage); err != nil {
+			return err
+		}
+		s.storage = storage
+		go s.snapshotLoop(s.done)
+	} else {
+		epoch, err := s.nextEpoch()
+		if err != nil {
+			return err
+		}
+		s.epoch = epoch
+		s.origin = originID(s.n.ID(), epoch)
+		if epoch > 0 && s.config.GC {
+			go s.recoverState()
+		}
+	}
+	if s.config.Signed {
+		return s.setupKey()
+	}
+	return nil
+}
+
+// Messages can be any JSON value. TTL is the lifetime of the message in
+// milliseconds, and overrides MessageTTL. Consistency is one of the
+// CONSISTENCY_* constants, and decides how many nodes must have the message
+// before we reply.
+type BroadcastInput struct {
+	Type        string          `json:"type"`
+	Message     json.RawMessage `json:"message"`
+	TTL         int64           `json:"ttl,omitempty"`
+	Consistency string          `json:"consistency,omitempty"`
+}
+
+type BroadcastOutput struct {
+	Type string `json:"type"`
+}
+
+func (s *Server) broadcastHandler(msg maelstrom.Message) error {
+	var inputBody BroadcastInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	data, err := canonicalPayload(inputBody.Message)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("invalid message: %v", err))
+	}
+	if len(data) > s.config.MaxPayloadSize {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("message is larger than %d bytes", s.config.MaxPayloadSize))
+	}
+	count, err := s.replicas(inputBody.Consistency)
+	if err != nil {
+		return err
+	}
+
+	s.msgsMu.Lock()
+	added := !s.msgs.Contains(data)
+	origin := s.origin
+	var entry Entry
+	if added {
+		s.seq++
+		entry = Entry{Seq: s.seq, Data: data}
+		if ttl := time.Duration(inputBody.TTL) * time.Millisecond; ttl > 0 {
+			entry.Expires = time.Now().Add(ttl).UnixMilli()
+		} else if s.config.MessageTTL > 0 {
+			entry.Expires = time.Now().Add(s.config.MessageTTL).UnixMilli()
+		}
+		if s.config.Order == ORDER_TOTAL {
+			s.clock++
+			entry.Timestamp = s.clock
+		}
+		s.sign(&entry)
+		if !s.addEntry(s.origin, entry) {
+			s.msgsMu.Unlock()
+			return maelstrom.NewRPCError(maelstrom.Abort, fmt.Sprintf("sequence number %d of %v is already taken", entry.Seq, s.origin))
+		}
+		s.notifyNewMessages(1)
+	} else {
+		// Somebody already broadcast the same payload, so if we need to
+		// replicate it we replicate their message.
+		origin, entry, _ = s.msgs.Get(data)
+	}
+	s.msgsMu.Unlock()
+
+	if added && s.config.Eager {
+		s.push("", s.origin, entry)
+	}
+	if count > 0 {
+		if err := s.replicate(origin, entry, count); err != nil {
+			return err
+		}
+	}
+
+	outputBody := BroadcastOutput{
+		Type: "broadcast_ok",
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// originLog must be called with msgsMu held.
+func (s *Server) originLog(origin string) *OriginLog {
+	if _, ok := s.logs[origin]; !ok {
+		s.logs[origin] = NewOriginLog()
+	}
+	return s.logs[origin]
+}
+
+// versionVector must be called with msgsMu held.
+func (s *Server) versionVector() VersionVector {
+	res := make(VersionVector, len(s.logs))
+	for origin, log := range s.logs {
+		res[origin] = log.contiguous
+	}
+	return res
+}
+
+// If Since is set, read only returns the messages delivered after the one
+// with that index. Last is the index of the last message we delivered, which
+// the client can use as Since in the next read. Cursor and NextCursor work in
+// the same way, but they are opaque to the client, and they still work if the
+// client talks to a different node.
+// Consistency is one of the CONSISTENCY_* constants, CONSISTENCY_LOCAL by
+// default.
+type ReadInput struct {
+	Type        string `json:"type"`
+	MsgID       int    `json:"msg_id"`
+	Since       int    `json:"since,omitempty"`
+	Cursor      string `json:"cursor,omitempty"`
+	Consistency string `json:"consistency,omitempty"`
+}
+
+type ReadOutput struct {
+	Type       string            `json:"type"`
+	InReplyTo  int               `json:"in_reply_to"`
+	Messages   []json.RawMessage `json:"messages"`
+	Last       int               `json:"last"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+func (s *Server) readHandler(msg maelstrom.Message) error {
+	var inputBody ReadInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+
+	since := inputBody.Since
+	if inputBody.Cursor != "" {
+		var err error
+		since, err = s.cursorIndex(inputBody.Cursor)
+		if err != nil {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+		}
+	}
+
+	var stable VersionVector
+	switch inputBody.Consistency {
+	case "", CONSISTENCY_LOCAL:
+	case CONSISTENCY_QUORUM:
+		if err := s.readQuorum(); err != nil {
+			return err
+		}
+	case CONSISTENCY_ACKED:
+		var err error
+		if stable, err = s.ackedVersion(); err != nil {
+			return err
+		}
+	default:
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("invalid consistency %q", inputBody.Consistency))
+	}
+
+	// Indexes are assigned while holding msgsMu, so the messages and the
+	// last index are consistent with each other, even if a sync delivers new
+	// messages right after we release the lock.
+	s.msgsMu.RLock()
+	var messages []json.RawMessage
+	var last int
+	if stable != nil {
+		messages, last = s.msgs.Stable(since, time.Now().UnixMilli(), stable)
+	} else {
+		messages = s.msgs.Since(since, time.Now().UnixMilli())
+		last = s.msgs.Last()
+	}
+	s.msgsMu.RUnlock()
+
+	outputBody := ReadOutput{
+		Type:       "read_ok",
+		InReplyTo:  inputBody.MsgID,
+		Messages:   messages,
+		Last:       last,
+		NextCursor: Cursor{Node: s.n.ID(), Incarnation: s.incarnation, Index: last}.Encode(),
+	}
+	// We don't use Reply, because it decodes the body into a map[string]any,
+	// which would turn the numbers inside the payloads into float64.
+	return s.n.Send(msg.Src, outputBody)
+}
+
+type TopologyInput struct {
+	Type     string              `json:"type"`
+	Topology map[string][]string `json:"topology"`
+}
+
+type TopologyOutput struct {
+	Type string `json:"type"`
+}
+
+func (s *Server) topologyHandler(msg maelstrom.Message) error {
+	var inputBody TopologyInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	s.neighborsMu.Lock()
+	s.topology = inputBody.Topology
+	s.setNeighbors(s.strategy.Neighbors(s.n.ID(), s.membership.Members, s.topology))
+	s.neighborsMu.Unlock()
+
+	outputBody := TopologyOutput{
+		Type: "topology_ok",
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// setNeighbors must be called with neighborsMu held.
+func (s *Server) setNeighbors(neighbors []string) {
+	s.neighbors = neighbors
+	for _, neighbor := range s.neighbors {
+		s.track(neighbor)
+	}
+}
+
+// track initializes the state of a node that we sync with. It must be called
+// with neighborsMu held.
+func (s *Server) track(neighbor string) {
+	if _, ok := s.neighborsAcks[neighbor]; !ok {
+		s.neighborsAcks[neighbor] = make(VersionVector)
+	}
+	if _, ok := s.lastSeen[neighbor]; !ok {
+		s.lastSeen[neighbor] = time.Now()
+	}
+	s.detector(neighbor)
+}
+
+// setAcks replaces the version vector of a neighbor. It must be called with
+// neighborsMu held.
+func (s *Server) setAcks(neighbor string, version VersionVector) {
+	if version == nil {
+		version = make(VersionVector)
+	}
+	s.neighborsAcks[neighbor] = version
+	s.appendRecord(Record{Neighbor: neighbor, Acks: version})
+}
+
+// Syncs implement push-based anti-entropy: both the request and the response
+// contain the version vector of the sender, and the request only contains the
+// messages that are not covered by the last version vector we received from
+// the destination. Messages maps every origin to a list of entries. With the
+// total order, both also contain the promises known by the sender, and with
+// the garbage collector the versions known by the sender. If the membership
+// changed since the beginning, they also contain the membership.
+//
+// A node that routes around a suspected neighbor sets Detour in the syncs that
+// it sends to the detour. The detour doesn't become a neighbor of the sender,
+// otherwise the link would outlive the failure: instead, it replies with the
+// messages that the sender is missing, so that they flow in both directions
+// for as long as the detour lasts.
+//
+// SyncID identifies the sync among the ones sent by the same node, and the
+// sync_ok echoes it, so that the sender can tell the reply to the sync in
+// flight from a late reply to one that it considered lost.
+type SyncInput struct {
+	Type       string                 `json:"type"`
+	SyncID     int                    `json:"sync_id"`
+	Messages   map[string][]Entry     `json:"messages"`
+	Packed     map[string]string      `json:"packed,omitempty"`
+	Version    VersionVector          `json:"version"`
+	Promises   map[string]Promise     `json:"promises,omitempty"`
+	Versions   map[string]NodeVersion `json:"versions,omitempty"`
+	Membership *Membership            `json:"membership,omitempty"`
+	Encodings  []string               `json:"encodings,omitempty"`
+	Detour     bool                   `json:"detour,omitempty"`
+}
+
+type SyncOutput struct {
+	Type       string                 `json:"type"`
+	SyncID     int                    `json:"sync_id"`
+	Messages   map[string][]Entry     `json:"messages,omitempty"`
+	Version    VersionVector          `json:"version"`
+	Promises   map[string]Promise     `json:"promises,omitempty"`
+	Versions   map[string]NodeVersion `json:"versions,omitempty"`
+	Membership *Membership            `json:"membership,omitempty"`
+	Encodings  []string               `json:"encodings,omitempty"`
+}
+
+// syncHandler never returns an error: syncs don't have a msg_id, so the
+// library would send the error to the sender as a message that it has no
+// handler for, and its Run would fail. We log the invalid syncs and drop them,
+// and the sender sends them again once it considers them lost.
+func (s *Server) syncHandler(msg maelstrom.Message) error {
+	var inputBody SyncInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		log.Printf("invalid sync from %v: %v", msg.Src, err)
+		return nil
+	}
+
+	outputBody := s.receiveSync(msg.Src, inputBody)
+	outputBody.Type = "sync_ok"
+	outputBody.SyncID = inputBody.SyncID
+
+	if inputBody.Detour {
+		s.msgsMu.RLock()
+		chunks := s.chunks(inputBody.Version)
+		s.msgsMu.RUnlock()
+		if len(chunks) > 0 {
+			outputBody.Messages = chunks[0]
+		}
+	} else {
+		// The overlay is always symmetric, so if somebody we don't know
+		// syncs with us it must have changed its neighbors after a
+		// failover or a membership change, and we start syncing with it
+		// too. Nodes that left keep syncing with us for a while, but we
+		// don't sync with them.
+		s.neighborsMu.Lock()
+		if !contains(s.neighbors, msg.Src) && contains(s.membership.Members, msg.Src) {
+			s.setNeighbors(append(s.neighbors, msg.Src))
+		}
+		s.neighborsMu.Unlock()
+	}
+
+	if err := s.n.Send(msg.Src, outputBody); err != nil {
+		log.Printf("replying to the sync of %v: %v", msg.Src, err)
+	}
+	return nil
+}
+
+// addMessages adds the messages that we received from another node, and
+// returns the ones that were new. It must be called with msgsMu held.
+func (s *Server) addMessages(messages map[string][]Entry) map[string][]Entry {
+	res := map[string][]Entry{}
+	added := 0
+	for origin, entries := range messages {
+		for _, entry := range entries {
+			if s.addEntry(origin, entry) {
+				res[origin] = append(res[origin], entry)
+				added++
+			}
+		}
+	}
+	if added > 0 {
+		s.notifyNewMessages(added)
+	}
+	return res
+}
+
+// receiveSync merges the state that src sent us, and returns ours.
+func (s *Server) receiveSync(src string, inputBody SyncInput) SyncOutput {
+	messages := inputBody.Messages
+	if inputBody.Packed != nil {
+		// If the messages are corrupted we still merge the rest of the
+		// sync: the sender will send the messages again, since our version
+		// vector doesn't cover them.
+		unpacked, err := unpackMessages(inputBody.Packed)
+		if err != nil {
+			log.Printf("invalid packed messages from %v: %v", src, err)
+		}
+		if messages == nil {
+			messages = make(map[string][]Entry, len(unpacked))
+		}
+		for origin, entries := range unpacked {
+			messages[origin] = append(messages[origin], entries...)
+		}
+	}
+	messages = s.verifyMessages(src, messages)
+	// We only advance sentVersions when we send a sync, so if this reply
+	// gets lost the versions go out again with the next one.
+	s.neighborsMu.RLock()
+	sentVersions := s.sentVersions[src]
+	s.neighborsMu.RUnlock()
+	s.msgsMu.Lock()
+	added := s.addMessages(messages)
+	s.mergePromises(inputBody.Promises)
+	s.mergeVersions(inputBody.Versions)
+	version := s.versionVector()
+	promises := s.copyPromises()
+	versions, _ := s.copyVersions(sentVersions)
+	s.msgsMu.Unlock()
+
+	s.neighborsMu.Lock()
+	if inputBody.Membership != nil {
+		s.setMembership(*inputBody.Membership)
+	}
+	s.setAcks(src, inputBody.Version)
+	s.setEncodings(src, inputBody.Encodings)
+	s.announce(src, inputBody.Version)
+	s.heard(src)
+	membership := s.copyMembership()
+	s.neighborsMu.Unlock()
+
+	s.pushAll(src, added)
+	return SyncOutput{
+		Version:    version,
+		Promises:   promises,
+		Versions:   versions,
+		Membership: membership,
+		Encodings:  s.encodings(),
+	}
+}
+
+func main() {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	strategy, err := NewStrategy(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := NewServer(config, strategy)
+
+	s.n.Handle("init", s.initHandler)
+	s.n.Handle("broadcast", s.broadcastHandler)
+	s.n.Handle("read", s.readHandler)
+	s.n.Handle("fetch", s.fetchHandler)
+	s.n.Handle("replicate", s.replicateHandler)
+	s.n.Handle("topology", s.topologyHandler)
+	s.n.Handle("sync", s.syncHandler)
+	s.n.Handle("sync_ok", s.syncOkHandler)
+	s.n.Handle("join", s.joinHandler)
+	s.n.Handle("admit", s.admitHandler)
+	s.n.Handle("leave", s.leaveHandler)
+	s.n.Handle("status", s.statusHandler)
+	s.n.Handle("push", s.pushHandler)
+	s.n.Handle("prune", s.pruneHandler)
+	s.n.Handle("graft", s.graftHandler)
+	s.n.Handle("ping", s.pingHandler)
+	s.n.Handle("ping_ok", s.pingOkHandler)
+	s.n.Handle("ping_req", s.pingReqHandler)
+	s.n.Handle("ping_req_ok", s.pingReqOkHandler)
+
+	if swim, ok := strategy.(*SwimStrategy); ok {
+		go s.swimLoop(swim, s.done)
+	} else {
+		go s.syncLoop(s.done)
+	}
+	if config.GC {
+		go s.gcLoop(s.done)
+	}
+
+	err = s.n.Run()
+	close(s.done)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// For read, CONSISTENCY_LOCAL returns the messages that we have,
+	// CONSISTENCY_QUORUM also the ones that a majority of the nodes has, and
+	// CONSISTENCY_ACKED only the ones that every node has. For broadcast, they
+	// decide whether we wait for a majority or for all the nodes to store the
+	// message.
+	CONSISTENCY_LOCAL  = "local"
+	CONSISTENCY_QUORUM = "quorum"
+	CONSISTENCY_ACKED  = "acked"
+
+	// READ_TIMEOUT is how long a quorum or acked read or broadcast waits
+	// for the other nodes.
+	READ_TIMEOUT = time.Second
+)
+
+// replicas returns the number of other nodes that must receive a message
+// before we reply to broadcast.
+func (s *Server) replicas(consistency string) (int, error) {
+	s.msgsMu.RLock()
+	defer s.msgsMu.RUnlock()
+	switch consistency {
+	case "", CONSISTENCY_LOCAL:
+		return 0, nil
+	case CONSISTENCY_QUORUM:
+		return len(s.members) / 2, nil
+	case CONSISTENCY_ACKED:
+		return len(others(s.n.ID(), s.members)), nil
+	default:
+		return 0, maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("invalid consistency %q", consistency))
+	}
+}
+
+// A broadcast with consistency quorum or acked sends the message to all the
+// other members with the replicate rpc, and waits until enough of them have
+// stored it. Any two majorities intersect, so a quorum read on any node sees
+// the messages of the quorum broadcasts that already replied.
+type ReplicateInput struct {
+	Type   string `json:"type"`
+	Origin string `json:"origin"`
+	Entry
+}
+
+type ReplicateOutput struct {
+	Type string `json:"type"`
+}
+
+func (s *Server) replicateHandler(msg maelstrom.Message) error {
+	var inputBody ReplicateInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	if !s.verify(msg.Src, inputBody.Origin, inputBody.Entry) {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "invalid signature")
+	}
+
+	s.msgsMu.Lock()
+	added := s.addEntry(inputBody.Origin, inputBody.Entry)
+	if added {
+		s.notifyNewMessages(1)
+	}
+	s.msgsMu.Unlock()
+	if added {
+		s.pushAll(msg.Src, map[string][]Entry{inputBody.Origin: {inputBody.Entry}})
+	}
+
+	outputBody := ReplicateOutput{
+		Type: "replicate_ok",
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// rpcReply is the reply of a member to one of the rpcs sent by rpcAll, or the
+// error that prevented us from sending it.
+type rpcReply struct {
+	src string
+	msg maelstrom.Message
+	err error
+}
+
+// rpcAll sends body to all the members with an rpc, and returns the channel
+// where their replies arrive. We don't use SyncRPC, because its callback
+// blocks forever on a reply that arrives after we stopped waiting, and the
+// library waits for all the callbacks before Run returns. The channel has room
+// for a reply from every member, so the callbacks never block, and the replies
+// that nobody reads are dropped with the channel.
+func (s *Server) rpcAll(members []string, body any) <-chan rpcReply {
+	replies := make(chan rpcReply, len(members))
+	for _, member := range members {
+		member := member
+		err := s.n.RPC(member, body, func(msg maelstrom.Message) error {
+			reply := rpcReply{src: member, msg: msg}
+			if err := msg.RPCError(); err != nil {
+				reply.err = err
+			}
+			replies <- reply
+			return nil
+		})
+		if err != nil {
+			replies <- rpcReply{src: member, err: err}
+		}
+	}
+	return replies
+}
+
+// replicate sends a message to all the other members, and waits until count
+// of them acknowledge it.
+func (s *Server) replicate(origin string, entry Entry, count int) error {
+	s.msgsMu.RLock()
+	members := others(s.n.ID(), s.members)
+	s.msgsMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), READ_TIMEOUT)
+	defer cancel()
+	replies := s.rpcAll(members, ReplicateInput{Type: "replicate", Origin: origin, Entry: entry})
+	acked := 0
+	for i := 0; i < len(members) && acked < count && ctx.Err() == nil; i++ {
+		select {
+		case reply := <-replies:
+			if reply.err == nil {
+				acked++
+			}
+		case <-ctx.Done():
+		}
+	}
+	if acked < count {
+		// The message will still reach everybody, so the error must be
+		// indefinite. We can't use Timeout, because the library omits code
+		// 0 from the error body.
+		return maelstrom.NewRPCError(maelstrom.Crash, fmt.Sprintf("only %d of %d nodes stored the message", acked, count))
+	}
+	return nil
+}
+
+// For the stronger consistency levels, read fetches the state of the other
+// members before replying. A fetch carries our version vector, and the reply
+// contains the version vector of the member and the messages that we miss,
+// which we add to our own logs like in a sync. This way the reply to read
+// still comes from our own set of messages, and the cursors keep working.
+type FetchInput struct {
+	Type    string        `json:"type"`
+	Version VersionVector `json:"version"`
+}
+
+type FetchOutput struct {
+	Type     string             `json:"type"`
+	Version  VersionVector      `json:"version"`
+	Messages map[string][]Entry `json:"messages"`
+}
+
+func (s *Server) fetchHandler(msg maelstrom.Message) error {
+	var inputBody FetchInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+
+	s.msgsMu.RLock()
+	messages := map[string][]Entry{}
+	for origin, log := range s.logs {
+		if entries := log.After(inputBody.Version[origin]); len(entries) > 0 {
+			messages[origin] = entries
+		}
+	}
+	version := s.versionVector()
+	s.msgsMu.RUnlock()
+
+	outputBody := FetchOutput{
+		Type:     "fetch_ok",
+		Version:  version,
+		Messages: messages,
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// fetch sends a fetch to all the other members, and waits until count of them
+// reply. It returns the version vectors of the members that replied, ours
+// included.
+func (s *Server) fetch(count int) ([]VersionVector, error) {
+	s.msgsMu.RLock()
+	members := others(s.n.ID(), s.members)
+	version := s.versionVector()
+	s.msgsMu.RUnlock()
+	if count > len(members) {
+		count = len(members)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), READ_TIMEOUT)
+	defer cancel()
+	replies := s.rpcAll(members, FetchInput{Type: "fetch", Version: version})
+	versions := []VersionVector{version}
+	for i := 0; i < len(members) && len(versions) <= count && ctx.Err() == nil; i++ {
+		var reply rpcReply
+		select {
+		case reply = <-replies:
+		case <-ctx.Done():
+			continue
+		}
+		if reply.err != nil {
+			continue
+		}
+		var outputBody FetchOutput
+		if err := json.Unmarshal(reply.msg.Body, &outputBody); err != nil {
+			continue
+		}
+		messages := s.verifyMessages(reply.src, outputBody.Messages)
+		s.msgsMu.Lock()
+		added := s.addMessages(messages)
+		s.msgsMu.Unlock()
+		s.pushAll(reply.src, added)
+		versions = append(versions, outputBody.Version)
+	}
+	if len(versions) <= count {
+		return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, fmt.Sprintf("only %d of %d nodes replied", len(versions)-1, count))
+	}
+	return versions, nil
+}
+
+// readQuorum adds to our logs the messages that a majority of the members
+// has, ourselves included. Since any two majorities intersect, after
+// broadcast_ok a quorum read on any node sees the message as soon as it has
+// reached a majority of the nodes.
+func (s *Server) readQuorum() error {
+	s.msgsMu.RLock()
+	count := len(s.members) / 2
+	s.msgsMu.RUnlock()
+	_, err := s.fetch(count)
+	return err
+}
+
+// ackedVersion returns the version vector that every member has confirmed,
+// by asking all of them.
+func (s *Server) ackedVersion() (VersionVector, error) {
+	s.msgsMu.RLock()
+	count := len(s.members)
+	s.msgsMu.RUnlock()
+	versions, err := s.fetch(count)
+	if err != nil {
+		return nil, err
+	}
+
+	res := versions[0].Copy()
+	for _, version := range versions[1:] {
+		for origin, seq := range res {
+			if version[origin] < seq {
+				res[origin] = version[origin]
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// A Cursor points to a position in the delivery order of a node. Indexes are
+// local to a node, and to an incarnation of that node, since a restarted
+// node delivers the messages again in a different order. Clients only see the
+// encoded cursor, so we are free to change what's inside.
+type Cursor struct {
+	Node        string
+	Incarnation string
+	Index       int
+}
+
+func newIncarnation() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v %v %d", c.Node, c.Incarnation, c.Index)))
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	var c Cursor
+	if _, err := fmt.Sscanf(string(buf), "%s %s %d", &c.Node, &c.Incarnation, &c.Index); err != nil || c.Index < 0 {
+		return Cursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	return c, nil
+}
+
+// cursorIndex returns the index that a cursor points to. A cursor created by
+// another node, or by a previous incarnation of this node, doesn't mean
+// anything here, so we start from the beginning: the client gets some
+// messages twice, but it doesn't miss any.
+func (s *Server) cursorIndex(encoded string) (int, error) {
+	c, err := DecodeCursor(encoded)
+	if err != nil {
+		return 0, err
+	}
+	if c.Node != s.n.ID() || c.Incarnation != s.incarnation {
+		return 0, nil
+	}
+	return c.Index, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// PHI_THRESHOLD is the suspicion level above which we consider a
+	// neighbor dead. With a normal distribution, 8 means that the
+	// probability of being wrong is about 10^-8.
+	PHI_THRESHOLD = 8.0
+	// PHI_MAX caps the suspicion level, which can grow to infinity.
+	PHI_MAX = 100.0
+	// PHI_WINDOW_SIZE is the number of intervals between heartbeats that we
+	// remember for each neighbor.
+	PHI_WINDOW_SIZE = 100
+	// PHI_MIN_STDDEV prevents the detector from becoming too sensitive when
+	// the heartbeats are very regular.
+	PHI_MIN_STDDEV = 100 * time.Millisecond
+)
+
+// A PhiDetector is a phi-accrual failure detector. Instead of deciding
+// whether a neighbor is dead after a fixed timeout, it learns the distribution
+// of the intervals between the heartbeats of the neighbor (for us, the syncs
+// and the sync_oks that we receive from it) and it outputs a suspicion level
+// phi: the probability that the neighbor is alive but we didn't hear from it
+// for this long is 10^-phi.
+//
+// When there are no new messages, we only exchange a sync with a neighbor every
+// MaxSyncTimeout or so, while under load we do it every SyncTimeout, so the
+// intervals suddenly grow when the load stops. acceptablePause is added to the
+// mean interval to avoid suspecting everybody when this happens.
+type PhiDetector struct {
+	intervals       []float64
+	last            time.Time
+	acceptablePause time.Duration
+}
+
+// NewPhiDetector creates a detector that expects a heartbeat every expected,
+// until it learns the real distribution.
+func NewPhiDetector(expected, acceptablePause time.Duration) *PhiDetector {
+	return &PhiDetector{
+		intervals:       []float64{float64(expected.Milliseconds())},
+		last:            time.Now(),
+		acceptablePause: acceptablePause,
+	}
+}
+
+func (d *PhiDetector) Heartbeat(now time.Time) {
+	d.intervals = append(d.intervals, float64(now.Sub(d.last).Milliseconds()))
+	if len(d.intervals) > PHI_WINDOW_SIZE {
+		d.intervals = d.intervals[1:]
+	}
+	d.last = now
+}
+
+// Phi returns the suspicion level at time now. We approximate the cumulative
+// distribution function of the normal distribution with a logistic function,
+// like Akka does.
+func (d *PhiDetector) Phi(now time.Time) float64 {
+	mean, stddev := d.stats()
+	mean += float64(d.acceptablePause.Milliseconds())
+	elapsed := float64(now.Sub(d.last).Milliseconds())
+
+	y := (elapsed - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	var phi float64
+	if elapsed > mean {
+		phi = -math.Log10(e / (1 + e))
+	} else {
+		phi = -math.Log10(1 - 1/(1+e))
+	}
+	if math.IsNaN(phi) || phi > PHI_MAX {
+		return PHI_MAX
+	}
+	return phi
+}
+
+// stats returns the mean and the standard deviation of the intervals, in
+// milliseconds.
+func (d *PhiDetector) stats() (float64, float64) {
+	sum := 0.0
+	for _, interval := range d.intervals {
+		sum += interval
+	}
+	mean := sum / float64(len(d.intervals))
+	variance := 0.0
+	for _, interval := range d.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(d.intervals)))
+	if minStddev := float64(PHI_MIN_STDDEV.Milliseconds()); stddev < minStddev {
+		stddev = minStddev
+	}
+	return mean, stddev
+}
+
+// heard records that we received a sync or a sync_ok from a node. It must be
+// called with neighborsMu held.
+func (s *Server) heard(neighbor string) {
+	now := time.Now()
+	s.lastSeen[neighbor] = now
+	s.detector(neighbor).Heartbeat(now)
+}
+
+// detector must be called with neighborsMu held.
+func (s *Server) detector(neighbor string) *PhiDetector {
+	if _, ok := s.detectors[neighbor]; !ok {
+		s.detectors[neighbor] = NewPhiDetector(s.config.MaxSyncTimeout, 2*s.config.MaxSyncTimeout)
+	}
+	return s.detectors[neighbor]
+}
+
+// checkFailures updates the set of neighbors that we suspect, and routes
+// around them. If the strategy knows how to do it, we let it choose our new
+// neighbors. Otherwise we take a detour: while we suspect a neighbor, we sync
+// with its own neighbors instead, so that the messages reach the rest of the
+// overlay through them. We keep probing the suspected neighbors from time to
+// time, and the detour goes away as soon as we hear from them again.
+func (s *Server) checkFailures() {
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	now := time.Now()
+	for _, neighbor := range s.neighbors {
+		suspected := s.detector(neighbor).Phi(now) > PHI_THRESHOLD
+		if suspected == s.suspected[neighbor] {
+			continue
+		}
+		if !suspected {
+			log.Printf("%v is alive again", neighbor)
+			delete(s.suspected, neighbor)
+			delete(s.detours, neighbor)
+			continue
+		}
+
+		log.Printf("suspecting %v", neighbor)
+		s.suspected[neighbor] = true
+		if strategy, ok := s.strategy.(FailoverStrategy); ok {
+			s.setNeighbors(strategy.Failover(s.n.ID(), s.neighbors, neighbor))
+			continue
+		}
+		detours := []string{}
+		for _, other := range s.strategy.Neighbors(neighbor, s.membership.Members, s.topology) {
+			if other != s.n.ID() && !s.suspected[other] {
+				detours = append(detours, other)
+				s.track(other)
+			}
+		}
+		s.detours[neighbor] = detours
+	}
+}
+
+// activeNeighbors returns the neighbors that we don't suspect, plus the
+// detours around the ones that we suspect. It must be called with neighborsMu
+// held.
+func (s *Server) activeNeighbors() []string {
+	res := []string{}
+	for _, neighbor := range s.neighbors {
+		if !s.suspected[neighbor] {
+			res = append(res, neighbor)
+		}
+	}
+	for _, neighbor := range s.neighbors {
+		for _, detour := range s.detours[neighbor] {
+			if !s.suspected[detour] && !contains(res, detour) {
+				res = append(res, detour)
+			}
+		}
+	}
+	return res
+}
+
+// The status rpc reports what the node thinks of its neighbors and how many
+// messages each of them still has to receive, how many forged messages it
+// rejected, and how many syncs and pushes it sent to other regions, for
+// debugging.
+type StatusInput struct {
+	Type string `json:"type"`
+}
+
+type StatusOutput struct {
+	Type      string                    `json:"type"`
+	Neighbors map[string]NeighborStatus `json:"neighbors"`
+	Detours   map[string][]string       `json:"detours"`
+	Rejected  int64                     `json:"rejected"`
+	// Region is our region, or -1 if the nodes are not split into regions.
+	Region      int   `json:"region"`
+	CrossRegion int64 `json:"cross_region"`
+}
+
+type NeighborStatus struct {
+	Phi        float64 `json:"phi"`
+	Suspected  bool    `json:"suspected"`
+	LastSeenMs int64   `json:"last_seen_ms"`
+	MeanMs     float64 `json:"mean_ms"`
+	// Queued is the number of messages that the neighbor hasn't
+	// acknowledged yet, and InFlightMs how long ago we sent the sync that
+	// it hasn't answered, or 0.
+	Queued     int   `json:"queued"`
+	InFlightMs int64 `json:"in_flight_ms"`
+}
+
+func (s *Server) statusHandler(msg maelstrom.Message) error {
+	var inputBody StatusInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+
+	s.neighborsMu.Lock()
+	now := time.Now()
+	neighbors := make(map[string]NeighborStatus, len(s.neighbors))
+	s.msgsMu.RLock()
+	for _, neighbor := range s.neighbors {
+		detector := s.detector(neighbor)
+		mean, _ := detector.stats()
+		var inFlight int64
+		if sync, ok := s.inFlight[neighbor]; ok {
+			inFlight = now.Sub(sync.sent).Milliseconds()
+		}
+		neighbors[neighbor] = NeighborStatus{
+			Phi:        detector.Phi(now),
+			Suspected:  s.suspected[neighbor],
+			LastSeenMs: now.Sub(s.lastSeen[neighbor]).Milliseconds(),
+			MeanMs:     mean,
+			Queued:     s.queued(s.neighborsAcks[neighbor]),
+			InFlightMs: inFlight,
+		}
+	}
+	s.msgsMu.RUnlock()
+	detours := make(map[string][]string, len(s.detours))
+	for neighbor, others := range s.detours {
+		detours[neighbor] = append([]string{}, others...)
+	}
+	s.neighborsMu.Unlock()
+
+	region := -1
+	if regions, ok := s.strategy.(RegionStrategy); ok {
+		region = regions.region(s.n.ID())
+	}
+	outputBody := StatusOutput{
+		Type:        "status_ok",
+		Neighbors:   neighbors,
+		Detours:     detours,
+		Rejected:    s.rejected.Load(),
+		Region:      region,
+		CrossRegion: s.crossRegion.Load(),
+	}
+	return s.n.Reply(msg, outputBody)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	ENCODING_JSON  = "json"
+	ENCODING_DELTA = "delta"
+
+	// The sequence numbers of a packed origin are either delta-encoded or
+	// run-length encoded, whichever is shorter.
+	seqsDelta byte = 0
+	seqsRuns  byte = 1
+)
+
+// By default the syncs carry the messages as JSON objects, which repeat the
+// field names for every message and escape the quotes inside the payloads.
+// With the delta encoding, the messages of each origin are packed in a binary
+// blob, which travels as a base64 string in the packed field of the sync:
+//
+//	count | mode | sequence numbers | count * (data, timestamp, expires, signature)
+//
+// All the integers are varints. The sequence numbers are sorted, and we
+// either write the first one followed by the differences between consecutive
+// ones, or a list of (gap, length) ranges of contiguous sequence numbers,
+// which is much shorter when a neighbor misses a long run of messages. Strings
+// are written as their length followed by their bytes.
+//
+// The encoding is chosen at startup (BROADCAST_ENCODING), and every sync and
+// sync_ok advertises the encodings that the sender understands. We only pack
+// the messages for a neighbor after it advertised the delta encoding, so nodes
+// that only speak JSON, and don't advertise anything, keep receiving JSON.
+
+// packMessages encodes the messages of every origin.
+func packMessages(messages map[string][]Entry) map[string]string {
+	res := make(map[string]string, len(messages))
+	for origin, entries := range messages {
+		res[origin] = base64.StdEncoding.EncodeToString(packEntries(entries))
+	}
+	return res
+}
+
+func unpackMessages(packed map[string]string) (map[string][]Entry, error) {
+	res := make(map[string][]Entry, len(packed))
+	for origin, encoded := range packed {
+		buf, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := unpackEntries(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid messages of %v: %w", origin, err)
+		}
+		res[origin] = entries
+	}
+	return res, nil
+}
+
+func packEntries(entries []Entry) []byte {
+	sorted := append([]Entry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Seq < sorted[j].Seq
+	})
+
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(sorted)))
+	delta, runs := deltaSeqs(sorted), runSeqs(sorted)
+	if len(runs) < len(delta) {
+		buf = append(buf, seqsRuns)
+		buf = append(buf, runs...)
+	} else {
+		buf = append(buf, seqsDelta)
+		buf = append(buf, delta...)
+	}
+	for _, entry := range sorted {
+		buf = appendString(buf, entry.Data)
+		buf = binary.AppendUvarint(buf, uint64(entry.Timestamp))
+		buf = binary.AppendUvarint(buf, uint64(entry.Expires))
+		buf = appendString(buf, entry.Signature)
+	}
+	return buf
+}
+
+func deltaSeqs(entries []Entry) []byte {
+	var buf []byte
+	prev := 0
+	for _, entry := range entries {
+		buf = binary.AppendUvarint(buf, uint64(entry.Seq-prev))
+		prev = entry.Seq
+	}
+	return buf
+}
+
+func runSeqs(entries []Entry) []byte {
+	var runs []byte
+	count, prev := 0, 0
+	for i := 0; i < len(entries); {
+		j := i + 1
+		for j < len(entries) && entries[j].Seq == entries[j-1].Seq+1 {
+			j++
+		}
+		runs = binary.AppendUvarint(runs, uint64(entries[i].Seq-prev))
+		runs = binary.AppendUvarint(runs, uint64(j-i))
+		prev = entries[j-1].Seq
+		count++
+		i = j
+	}
+	return append(binary.AppendUvarint(nil, uint64(count)), runs...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func unpackEntries(buf []byte) ([]Entry, error) {
+	r := bytes.NewReader(buf)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// Every entry takes at least 4 bytes, so we can reject absurd counts
+	// before allocating anything.
+	if count > uint64(len(buf)) {
+		return nil, errors.New("too many messages")
+	}
+	mode, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, count)
+	switch mode {
+	case seqsDelta:
+		prev := 0
+		for i := uint64(0); i < count; i++ {
+			delta, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			prev += int(delta)
+			entries = append(entries, Entry{Seq: prev})
+		}
+	case seqsRuns:
+		runs, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		prev := 0
+		for i := uint64(0); i < runs; i++ {
+			gap, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(entries))+length > count {
+				return nil, errors.New("too many sequence numbers")
+			}
+			start := prev + int(gap)
+			for seq := start; seq < start+int(length); seq++ {
+				entries = append(entries, Entry{Seq: seq})
+			}
+			prev = start + int(length) - 1
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %d", mode)
+	}
+	if uint64(len(entries)) != count {
+		return nil, errors.New("wrong number of sequence numbers")
+	}
+
+	for i := range entries {
+		if entries[i].Data, err = readString(r); err != nil {
+			return nil, err
+		}
+		timestamp, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		expires, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Timestamp = int(timestamp)
+		entries[i].Expires = int64(expires)
+		if entries[i].Signature, err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(r.Len()) {
+		return "", errors.New("string out of bounds")
+	}
+	buf := make([]byte, length)
+	if _, err := r.Read(buf); err != nil && length > 0 {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// encodings returns the encodings that we advertise.
+func (s *Server) encodings() []string {
+	if s.config.Encoding == ENCODING_DELTA {
+		return []string{ENCODING_DELTA}
+	}
+	return nil
+}
+
+// setEncodings records the encodings that a neighbor advertised. It must be
+// called with neighborsMu held.
+func (s *Server) setEncodings(neighbor string, encodings []string) {
+	s.packed[neighbor] = s.config.Encoding == ENCODING_DELTA && contains(encodings, ENCODING_DELTA)
+}
+
+// encodeMessages puts messages in a sync for neighbor, packing them if the
+// neighbor understands it. It must be called with neighborsMu held.
+func (s *Server) encodeMessages(neighbor string, body *SyncInput, messages map[string][]Entry) {
+	body.Encodings = s.encodings()
+	if s.packed[neighbor] && len(messages) > 0 {
+		body.Packed = packMessages(messages)
+		body.Messages = nil
+		return
+	}
+	body.Messages = messages
+}
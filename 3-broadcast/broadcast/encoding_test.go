@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func contiguousEntries(from, to int) []Entry {
+	res := []Entry{}
+	for seq := from; seq <= to; seq++ {
+		res = append(res, Entry{Seq: seq, Data: `"x"`})
+	}
+	return res
+}
+
+func TestPackEntriesRoundTrip(t *testing.T) {
+	tests := map[string][]Entry{
+		"empty":  {},
+		"single": {{Seq: 1, Data: "1"}},
+		"all fields": {
+			{Seq: 3, Data: `{"a":[1,2]}`, Timestamp: 17, Expires: 1700000000000, Signature: "c2lnbmF0dXJl"},
+			{Seq: 9, Data: `"héllo \"world\""`, Timestamp: 1 << 40},
+		},
+		"sparse":     {{Seq: 2, Data: "2"}, {Seq: 100, Data: "100"}, {Seq: 1000000, Data: "1000000"}},
+		"contiguous": contiguousEntries(1, 500),
+		"runs":       append(contiguousEntries(10, 200), contiguousEntries(300, 600)...),
+		"empty data": {{Seq: 1}, {Seq: 2, Data: ""}},
+	}
+	for name, entries := range tests {
+		unpacked, err := unpackEntries(packEntries(entries))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if len(entries) == 0 && len(unpacked) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(unpacked, entries) {
+			t.Errorf("%v: got %v, want %v", name, unpacked, entries)
+		}
+	}
+}
+
+func TestPackEntriesSorts(t *testing.T) {
+	entries := []Entry{{Seq: 5, Data: "5"}, {Seq: 1, Data: "1"}, {Seq: 3, Data: "3"}}
+	unpacked, err := unpackEntries(packEntries(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{Seq: 1, Data: "1"}, {Seq: 3, Data: "3"}, {Seq: 5, Data: "5"}}
+	if !reflect.DeepEqual(unpacked, want) {
+		t.Errorf("got %v, want %v", unpacked, want)
+	}
+}
+
+func TestPackEntriesMode(t *testing.T) {
+	if mode := packEntries(contiguousEntries(1, 100))[1]; mode != seqsRuns {
+		t.Errorf("contiguous sequence numbers use mode %d, want %d", mode, seqsRuns)
+	}
+	sparse := []Entry{{Seq: 1}, {Seq: 3}, {Seq: 5}, {Seq: 7}}
+	if mode := packEntries(sparse)[1]; mode != seqsDelta {
+		t.Errorf("sparse sequence numbers use mode %d, want %d", mode, seqsDelta)
+	}
+}
+
+func TestPackMessagesRoundTrip(t *testing.T) {
+	messages := map[string][]Entry{
+		"n0":   contiguousEntries(1, 50),
+		"n1/2": {{Seq: 7, Data: "[]", Timestamp: 3}},
+	}
+	unpacked, err := unpackMessages(packMessages(messages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unpacked, messages) {
+		t.Errorf("got %v, want %v", unpacked, messages)
+	}
+}
+
+func TestUnpackEntriesTruncated(t *testing.T) {
+	buf := packEntries([]Entry{
+		{Seq: 1, Data: "1", Timestamp: 4, Expires: 10},
+		{Seq: 2, Data: `"two"`, Signature: "sig"},
+		{Seq: 9, Data: "9"},
+	})
+	for i := 0; i < len(buf); i++ {
+		if entries, err := unpackEntries(buf[:i]); err == nil {
+			t.Errorf("prefix of %d bytes decodes to %v, want an error", i, entries)
+		}
+	}
+}
+
+func TestUnpackEntriesCorrupted(t *testing.T) {
+	uvarints := func(values ...uint64) []byte {
+		var buf []byte
+		for _, value := range values {
+			buf = binary.AppendUvarint(buf, value)
+		}
+		return buf
+	}
+	tests := map[string][]byte{
+		"empty":           {},
+		"count too high":  uvarints(1000, uint64(seqsDelta), 1),
+		"unknown mode":    uvarints(1, 7, 1, 0, 0, 0, 0),
+		"run too long":    uvarints(2, uint64(seqsRuns), 1, 1, 3, 0, 0, 0, 0, 0, 0, 0, 0),
+		"missing runs":    uvarints(2, uint64(seqsRuns), 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0),
+		"string too long": append(uvarints(1, uint64(seqsDelta), 1, 5), "abc"...),
+		"huge string":     uvarints(1, uint64(seqsDelta), 1, 1<<62),
+		"bad varint":      {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, buf := range tests {
+		if entries, err := unpackEntries(buf); err == nil {
+			t.Errorf("%v: decodes to %v, want an error", name, entries)
+		}
+	}
+}
+
+func TestUnpackMessagesCorrupted(t *testing.T) {
+	tests := map[string]map[string]string{
+		"invalid base64": {"n0": "not base64!"},
+		"invalid entries": {
+			"n0": base64.StdEncoding.EncodeToString(packEntries(contiguousEntries(1, 3))),
+			"n1": base64.StdEncoding.EncodeToString([]byte{1, 9}),
+		},
+	}
+	for name, packed := range tests {
+		if messages, err := unpackMessages(packed); err == nil {
+			t.Errorf("%v: decodes to %v, want an error", name, messages)
+		}
+	}
+}
+
+func TestReadString(t *testing.T) {
+	buf := appendString(appendString(nil, ""), "abc")
+	r := bytes.NewReader(buf)
+	for _, want := range []string{"", "abc"} {
+		s, err := readString(r)
+		if err != nil || s != want {
+			t.Errorf("got %q, %v, want %q", s, err, want)
+		}
+	}
+	if s, err := readString(r); err == nil {
+		t.Errorf("reading past the end gives %q, want an error", s)
+	}
+
+	for _, length := range []uint64{4, 1 << 40} {
+		buf := append(binary.AppendUvarint(nil, length), "abc"...)
+		if s, err := readString(bytes.NewReader(buf)); err == nil {
+			t.Errorf("length %d over 3 bytes gives %q, want an error", length, s)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// GC_INTERVAL is the interval between two runs of the garbage collector.
+const GC_INTERVAL = time.Second
+
+// The garbage collector needs to know which messages every node has. Version
+// vectors only tell us about our neighbors, so when the garbage collector is
+// enabled the syncs also carry versions, the last version vector that we know
+// for every node, and every node merges them with its own. Taking the minimum
+// of all of them gives the stable version vector: the messages it covers have
+// been received by everybody, so nobody needs us to send them anymore. We
+// remove them from the origin logs, keeping only one copy of their payloads
+// for read, and we drop that copy too after the message expires.
+//
+// Sending every version vector in every sync would make each sync grow with
+// the square of the number of nodes, so we only send the entries that changed
+// since the last sync to the same neighbor, plus our own version vector. We
+// notice that a neighbor changed with versionsClock, a counter that we
+// increment every time we merge versions: every entry remembers the value of
+// the counter when it last grew, and sentVersions the value when we last
+// synced with each neighbor. If a sync gets lost, we send everything again.
+//
+// A node that restarts without its state forgets the messages that it had,
+// so its version vector goes back, which Merge would ignore. Versions are
+// tagged with the epoch of the node, and a newer epoch replaces the older
+// ones. The node also can't receive through the syncs the messages that the
+// others already removed from their logs, so it asks a member for a snapshot
+// (see recoverState).
+type NodeVersion struct {
+	Epoch   int           `json:"epoch,omitempty"`
+	Version VersionVector `json:"version"`
+	// changed contains, for every origin, the value of versionsClock when
+	// the entry last grew, and reset the value when the epoch started.
+	changed map[string]int
+	reset   int
+}
+
+// copyVersions returns the versions to send to other nodes that changed after
+// since, including our own version vector, and the current value of
+// versionsClock. It returns nil if we don't need them. It must be called with
+// msgsMu held.
+func (s *Server) copyVersions(since int) (map[string]NodeVersion, int) {
+	if !s.config.GC {
+		return nil, 0
+	}
+	res := make(map[string]NodeVersion)
+	for id, version := range s.versions {
+		changed := make(VersionVector)
+		for origin, seq := range version.Version {
+			if version.changed[origin] > since {
+				changed[origin] = seq
+			}
+		}
+		if len(changed) > 0 || version.reset > since {
+			res[id] = NodeVersion{Epoch: version.Epoch, Version: changed}
+		}
+	}
+	res[s.n.ID()] = NodeVersion{Epoch: s.epoch, Version: s.versionVector()}
+	return res, s.versionsClock
+}
+
+// mergeVersions must be called with msgsMu held.
+func (s *Server) mergeVersions(versions map[string]NodeVersion) {
+	if len(versions) == 0 {
+		return
+	}
+	s.versionsClock++
+	for id, version := range versions {
+		if id == s.n.ID() {
+			continue
+		}
+		current, ok := s.versions[id]
+		if !ok || version.Epoch > current.Epoch {
+			current = &NodeVersion{
+				Epoch:   version.Epoch,
+				Version: make(VersionVector),
+				changed: make(map[string]int),
+				reset:   s.versionsClock,
+			}
+			s.versions[id] = current
+		} else if version.Epoch < current.Epoch {
+			continue
+		}
+		for origin, seq := range version.Version {
+			if seq > current.Version[origin] {
+				current.Version[origin] = seq
+				current.changed[origin] = s.versionsClock
+			}
+		}
+	}
+}
+
+// stableVersion must be called with msgsMu held.
+func (s *Server) stableVersion() VersionVector {
+	res := make(VersionVector, len(s.logs))
+	for origin, originLog := range s.logs {
+		lowest := originLog.contiguous
+		for _, id := range s.members {
+			if id == s.n.ID() {
+				continue
+			}
+			seq := 0
+			if version, ok := s.versions[id]; ok {
+				seq = version.Version[origin]
+			}
+			if seq < lowest {
+				lowest = seq
+			}
+		}
+		res[origin] = lowest
+	}
+	return res
+}
+
+// recoverState asks the other members for a snapshot, one at a time until one
+// of them answers, after we restarted without our state.
+func (s *Server) recoverState() {
+	for _, member := range others(s.n.ID(), s.n.NodeIDs()) {
+		if err := s.admit(member); err != nil {
+			log.Printf("gc: recovering from %v: %v", member, err)
+			continue
+		}
+		log.Printf("gc: recovered the state of %v", member)
+		return
+	}
+}
+
+func (s *Server) gcLoop(done <-chan struct{}) {
+	t := time.NewTicker(GC_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.collectGarbage()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) collectGarbage() {
+	s.msgsMu.Lock()
+	defer s.msgsMu.Unlock()
+	stable := s.stableVersion()
+	for origin, originLog := range s.logs {
+		originLog.Compact(stable[origin])
+	}
+	if expired := s.msgs.Expire(time.Now().UnixMilli(), stable); expired > 0 {
+		log.Printf("gc: dropped %d expired messages", expired)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Every message is identified by its origin, the node that received it from
+// a client, and by a sequence number assigned by the origin. This lets us
+// summarize the messages that a node knows with a VersionVector, which maps
+// every origin to the highest sequence number up to which the node has all
+// the messages of that origin.
+//
+// A node that doesn't persist its state forgets the sequence numbers that it
+// assigned when it restarts, so every time it starts it takes a new epoch, and
+// the messages of each epoch have their own origin. Otherwise the restarted
+// node would reuse sequence numbers that the other nodes already have, with
+// different payloads, and they would drop the new messages as duplicates.
+type VersionVector map[string]int
+
+// originID returns the origin of the messages that node receives from clients
+// in the given epoch.
+func originID(node string, epoch int) string {
+	if epoch == 0 {
+		return node
+	}
+	return fmt.Sprintf("%v/%d", node, epoch)
+}
+
+// Merge sets every entry of v to the maximum between v and other.
+func (v VersionVector) Merge(other VersionVector) {
+	for origin, seq := range other {
+		if seq > v[origin] {
+			v[origin] = seq
+		}
+	}
+}
+
+func (v VersionVector) Copy() VersionVector {
+	res := make(VersionVector, len(v))
+	for origin, seq := range v {
+		res[origin] = seq
+	}
+	return res
+}
+
+// An Entry is a message of an OriginLog. Data is the payload in its canonical
+// JSON encoding. We send it to other nodes as a string, because the maelstrom
+// library decodes the bodies of RPCs into a map[string]any, which would turn
+// the numbers inside the payload into float64. Timestamp is the Lamport
+// timestamp of the message, which is only used for the total order, and
+// Expires is the time after which the message can be dropped, in Unix
+// milliseconds (0 if it never expires). Signature is the ed25519 signature of
+// the origin, in signed mode.
+type Entry struct {
+	Seq       int    `json:"seq"`
+	Data      string `json:"data"`
+	Timestamp int    `json:"ts,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+	Signature string `json:"sig,omitempty"`
+}
+
+// An OriginLog contains the messages of a single origin, indexed by their
+// sequence number. Sequence numbers start from 1. Messages can arrive out of
+// order, since they can travel through different paths.
+type OriginLog struct {
+	messages map[int]Entry
+	// contiguous is the highest sequence number such that we have all
+	// the messages up to it, and last is the highest one we have. The
+	// messages up to base have been removed by the garbage collector.
+	contiguous int
+	last       int
+	base       int
+}
+
+func NewOriginLog() *OriginLog {
+	return &OriginLog{
+		messages: make(map[int]Entry),
+	}
+}
+
+// Add inserts a message in the log, and returns false if it was already there.
+func (l *OriginLog) Add(entry Entry) bool {
+	if _, ok := l.messages[entry.Seq]; ok || entry.Seq <= l.base {
+		return false
+	}
+	l.messages[entry.Seq] = entry
+	if entry.Seq > l.last {
+		l.last = entry.Seq
+	}
+	for {
+		if _, ok := l.messages[l.contiguous+1]; !ok {
+			break
+		}
+		l.contiguous++
+	}
+	return true
+}
+
+// After returns the messages with sequence number greater than seq, except
+// the ones removed by the garbage collector, sorted by sequence number. We
+// walk the sequence numbers when there are fewer of them than messages, which
+// is the common case of a neighbor that is almost up to date, and the messages
+// otherwise: a single message with a huge sequence number would make us walk
+// billions of sequence numbers.
+func (l *OriginLog) After(seq int) []Entry {
+	if seq < l.base {
+		seq = l.base
+	}
+	res := []Entry{}
+	if l.last-seq <= len(l.messages) {
+		for i := seq + 1; i <= l.last; i++ {
+			if entry, ok := l.messages[i]; ok {
+				res = append(res, entry)
+			}
+		}
+		return res
+	}
+	for i, entry := range l.messages {
+		if i > seq {
+			res = append(res, entry)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Seq < res[j].Seq
+	})
+	return res
+}
+
+// Compact removes the messages up to seq from the log. We can only remove
+// messages up to contiguous, otherwise we would forget which ones we miss.
+func (l *OriginLog) Compact(seq int) {
+	if seq > l.contiguous {
+		seq = l.contiguous
+	}
+	for ; l.base < seq; l.base++ {
+		delete(l.messages, l.base+1)
+	}
+}
+
+// Skip marks all the messages up to seq as received and removed by the
+// garbage collector, because we received them in a snapshot. Like After, it
+// walks the messages instead of the sequence numbers up to seq.
+func (l *OriginLog) Skip(seq int) {
+	if l.base >= seq {
+		return
+	}
+	for i := range l.messages {
+		if i <= seq {
+			delete(l.messages, i)
+		}
+	}
+	l.base = seq
+	if l.contiguous < seq {
+		l.contiguous = seq
+	}
+	if l.last < seq {
+		l.last = seq
+	}
+	for {
+		if _, ok := l.messages[l.contiguous+1]; !ok {
+			break
+		}
+		l.contiguous++
+	}
+}
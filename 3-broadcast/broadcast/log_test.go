@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestOriginLogAfter(t *testing.T) {
+	l := NewOriginLog()
+	for _, seq := range []int{1, 2, 3, 5, 8} {
+		l.Add(Entry{Seq: seq})
+	}
+	tests := []struct {
+		seq  int
+		want []int
+	}{
+		{0, []int{1, 2, 3, 5, 8}},
+		{3, []int{5, 8}},
+		{4, []int{5, 8}},
+		{8, []int{}},
+	}
+	for _, test := range tests {
+		got := []int{}
+		for _, entry := range l.After(test.seq) {
+			got = append(got, entry.Seq)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("After(%d) = %v, want %v", test.seq, got, test.want)
+		}
+	}
+}
+
+func TestOriginLogHugeSeq(t *testing.T) {
+	l := NewOriginLog()
+	l.Add(Entry{Seq: 1})
+	l.Add(Entry{Seq: 2})
+	l.Add(Entry{Seq: math.MaxInt64 / 2})
+
+	// Before walking the messages, this took about 2^62 iterations.
+	got := []int{}
+	for _, entry := range l.After(0) {
+		got = append(got, entry.Seq)
+	}
+	if want := []int{1, 2, math.MaxInt64 / 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("After(0) = %v, want %v", got, want)
+	}
+	l.Skip(math.MaxInt64 / 4)
+	if got := l.After(0); len(got) != 1 || got[0].Seq != math.MaxInt64/2 {
+		t.Errorf("after Skip, After(0) = %v, want the last entry", got)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// MEMBERSHIP_KEY is the lin-kv key that contains the current membership.
+	MEMBERSHIP_KEY = "broadcast_membership"
+	KV_TIMEOUT     = time.Second
+	// JOIN_TIMEOUT is how long a joining node waits for the state transfer.
+	JOIN_TIMEOUT = 5 * time.Second
+	// LEAVE_TIMEOUT is how long a leaving node waits for its neighbors to
+	// receive its messages.
+	LEAVE_TIMEOUT = 5 * time.Second
+)
+
+// The Membership is the list of nodes that take part in the overlay. At the
+// beginning it contains the node IDs that maelstrom gives us in the init
+// message, with version 0. Every change goes through a compare-and-swap on
+// MEMBERSHIP_KEY in lin-kv, so concurrent changes can't get lost, and
+// increments the version. Then the new membership spreads through the syncs,
+// and every node that sees a newer version recomputes its neighbors.
+type Membership struct {
+	Version int      `json:"version"`
+	Members []string `json:"members"`
+}
+
+// changeMembership applies change to the current membership in lin-kv. If the
+// key doesn't exist yet, nobody changed the membership, so we start from ours.
+func (s *Server) changeMembership(change func(members []string) []string) (Membership, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+
+	for {
+		var current string
+		var membership Membership
+		exists := true
+		if err := s.kv.ReadInto(ctx, MEMBERSHIP_KEY, &current); err != nil {
+			if rpcErr, ok := err.(*maelstrom.RPCError); !ok || rpcErr.Code != maelstrom.KeyDoesNotExist {
+				return Membership{}, err
+			}
+			exists = false
+			s.neighborsMu.RLock()
+			membership = s.membership
+			s.neighborsMu.RUnlock()
+		} else if err := json.Unmarshal([]byte(current), &membership); err != nil {
+			return Membership{}, fmt.Errorf("corrupted membership %q: %w", current, err)
+		}
+
+		next := Membership{
+			Version: membership.Version + 1,
+			Members: change(membership.Members),
+		}
+		buf, err := json.Marshal(next)
+		if err != nil {
+			return Membership{}, err
+		}
+		err = s.kv.CompareAndSwap(ctx, MEMBERSHIP_KEY, current, string(buf), !exists)
+		if err == nil {
+			return next, nil
+		}
+		// Somebody else changed the membership in the meantime, so we try
+		// again from the new one.
+		if rpcErr, ok := err.(*maelstrom.RPCError); !ok || rpcErr.Code != maelstrom.PreconditionFailed {
+			return Membership{}, err
+		}
+	}
+}
+
+// setMembership adopts a membership if it is newer than ours, and recomputes
+// our neighbors. A node that left keeps its old neighbors, so that it can
+// finish sending them its messages. It must be called with neighborsMu held.
+func (s *Server) setMembership(membership Membership) {
+	if membership.Version <= s.membership.Version {
+		return
+	}
+	s.membership = membership
+	s.msgsMu.Lock()
+	s.members = membership.Members
+	s.msgsMu.Unlock()
+
+	if contains(membership.Members, s.n.ID()) {
+		s.setNeighbors(s.strategy.Neighbors(s.n.ID(), membership.Members, s.topology))
+	}
+	log.Printf("membership version %d: %v, neighbors %v", membership.Version, membership.Members, s.neighbors)
+}
+
+// copyMembership returns the membership to send to other nodes, or nil if it
+// never changed. It must be called with neighborsMu held.
+func (s *Server) copyMembership() *Membership {
+	if s.membership.Version == 0 {
+		return nil
+	}
+	return &Membership{
+		Version: s.membership.Version,
+		Members: append([]string{}, s.membership.Members...),
+	}
+}
+
+// A client asks a new node to join the overlay with a join message, which
+// contains a node that is already a member. The new node sends an admit
+// message to it, and the member adds the new node to the membership and
+// replies with its state, so that the new node doesn't need to receive all the
+// messages through the syncs.
+type JoinInput struct {
+	Type    string `json:"type"`
+	Contact string `json:"contact"`
+}
+
+type JoinOutput struct {
+	Type string `json:"type"`
+}
+
+// Epoch is the epoch of the new node, so that the member stops counting the
+// messages that the node had in an older epoch as received.
+type AdmitInput struct {
+	Type  string `json:"type"`
+	Epoch int    `json:"epoch,omitempty"`
+}
+
+type AdmitOutput struct {
+	Type       string     `json:"type"`
+	Membership Membership `json:"membership"`
+	Snapshot   *Snapshot  `json:"snapshot"`
+}
+
+func (s *Server) joinHandler(msg maelstrom.Message) error {
+	var inputBody JoinInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	if inputBody.Contact == "" || inputBody.Contact == s.n.ID() {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "join needs a contact that is already a member")
+	}
+	if err := s.admit(inputBody.Contact); err != nil {
+		return err
+	}
+
+	outputBody := JoinOutput{
+		Type: "join_ok",
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// admit asks contact to add us to the membership, and adopts the membership
+// and the state that it sends back.
+func (s *Server) admit(contact string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), JOIN_TIMEOUT)
+	defer cancel()
+	reply, err := s.n.SyncRPC(ctx, contact, AdmitInput{Type: "admit", Epoch: s.epoch})
+	if err != nil {
+		return err
+	}
+	var admit AdmitOutput
+	if err := json.Unmarshal(reply.Body, &admit); err != nil {
+		return err
+	}
+	if admit.Snapshot != nil {
+		records := []Record{}
+		for _, record := range admit.Snapshot.Records {
+			if record.Entry == nil || s.verify(reply.Src, record.Origin, *record.Entry) {
+				records = append(records, record)
+			}
+		}
+		admit.Snapshot.Records = records
+	}
+
+	s.neighborsMu.Lock()
+	s.msgsMu.Lock()
+	s.applySnapshot(admit.Snapshot, nil)
+	// We wake up the sync loop, so that our new neighbors learn about us
+	// as soon as possible.
+	s.notifyNewMessages(0)
+	s.msgsMu.Unlock()
+	s.setMembership(admit.Membership)
+	s.neighborsMu.Unlock()
+	return nil
+}
+
+func (s *Server) admitHandler(msg maelstrom.Message) error {
+	var inputBody AdmitInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	membership, err := s.changeMembership(func(members []string) []string {
+		if contains(members, msg.Src) {
+			return members
+		}
+		return append(append([]string{}, members...), msg.Src)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.neighborsMu.Lock()
+	s.setMembership(membership)
+	s.msgsMu.Lock()
+	s.mergeVersions(map[string]NodeVersion{msg.Src: {Epoch: inputBody.Epoch}})
+	snapshot := s.buildSnapshot(false)
+	s.msgsMu.Unlock()
+	s.neighborsMu.Unlock()
+
+	outputBody := AdmitOutput{
+		Type:       "admit_ok",
+		Membership: membership,
+		Snapshot:   snapshot,
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// A client asks a node to leave the overlay with a leave message. The node
+// removes itself from the membership, and replies once one of its neighbors
+// has all the messages that it received from clients (or after
+// LEAVE_TIMEOUT), so that the node can be stopped without losing them.
+type LeaveInput struct {
+	Type string `json:"type"`
+}
+
+type LeaveOutput struct {
+	Type string `json:"type"`
+}
+
+func (s *Server) leaveHandler(msg maelstrom.Message) error {
+	var inputBody LeaveInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		return err
+	}
+	membership, err := s.changeMembership(func(members []string) []string {
+		return others(s.n.ID(), members)
+	})
+	if err != nil {
+		return err
+	}
+	s.neighborsMu.Lock()
+	s.setMembership(membership)
+	s.neighborsMu.Unlock()
+
+	deadline := time.Now().Add(LEAVE_TIMEOUT)
+	for !s.handedOver() && time.Now().Before(deadline) {
+		time.Sleep(s.config.SyncTimeout)
+	}
+
+	outputBody := LeaveOutput{
+		Type: "leave_ok",
+	}
+	return s.n.Reply(msg, outputBody)
+}
+
+// handedOver returns true if one of our neighbors has all the messages that we
+// received from clients.
+func (s *Server) handedOver() bool {
+	s.msgsMu.RLock()
+	seq := s.seq
+	s.msgsMu.RUnlock()
+
+	s.neighborsMu.RLock()
+	defer s.neighborsMu.RUnlock()
+	for _, neighbor := range s.neighbors {
+		if s.neighborsAcks[neighbor][s.origin] >= seq {
+			return true
+		}
+	}
+	return false
+}
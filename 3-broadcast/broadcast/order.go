@@ -0,0 +1,152 @@
+package main
+
+import (
+	"container/heap"
+)
+
+const (
+	// ORDER_NONE delivers messages as soon as they arrive.
+	ORDER_NONE = "none"
+	// ORDER_FIFO delivers the messages of each origin in the order in which
+	// the origin received them.
+	ORDER_FIFO = "fifo"
+	// ORDER_TOTAL delivers all messages in the same order on every node.
+	ORDER_TOTAL = "total"
+)
+
+// A Promise is made by an origin when its Lamport clock is Clock and it has
+// assigned sequence numbers up to Seq: all its future messages will have a
+// timestamp greater than Clock. So, once we have all the messages of the
+// origin up to Seq, we know all its messages with timestamp up to Clock.
+// Promises are indexed by node, and Epoch tells us which origin of the node
+// they are about: a promise of a newer epoch replaces the older ones.
+type Promise struct {
+	Clock int `json:"clock"`
+	Seq   int `json:"seq"`
+	Epoch int `json:"epoch,omitempty"`
+}
+
+// addEntry inserts a message in the log of its origin, and delivers all the
+// messages that can be delivered according to the order mode. It returns
+// false if we already had the message. It must be called with msgsMu held.
+func (s *Server) addEntry(origin string, entry Entry) bool {
+	log := s.originLog(origin)
+	contiguous := log.contiguous
+	if !log.Add(entry) {
+		return false
+	}
+
+	s.appendRecord(Record{Origin: origin, Entry: &entry})
+
+	if s.config.Order == ORDER_FIFO {
+		for seq := contiguous + 1; seq <= log.contiguous; seq++ {
+			s.deliverEntry(origin, log.messages[seq])
+		}
+	} else {
+		s.deliverEntry(origin, entry)
+	}
+	return true
+}
+
+// deliverEntry delivers a message, or waits until it is stable with the total
+// order. With the FIFO order, the caller must make sure that all the previous
+// messages of the origin have been delivered. It must be called with msgsMu
+// held.
+func (s *Server) deliverEntry(origin string, entry Entry) {
+	if s.config.Order != ORDER_TOTAL {
+		s.msgs.Add(origin, entry)
+		return
+	}
+	if entry.Timestamp > s.clock {
+		s.clock = entry.Timestamp
+	}
+	s.setPromise(s.n.ID(), Promise{Clock: s.clock, Seq: s.seq, Epoch: s.epoch})
+	heap.Push(&s.undelivered, undeliveredEntry{Origin: origin, Entry: entry})
+	s.deliverStable()
+}
+
+// setPromise records a promise of a node, if it is newer than the one we
+// have. It must be called with msgsMu held.
+func (s *Server) setPromise(id string, promise Promise) {
+	current := s.promises[id]
+	if promise.Epoch < current.Epoch || promise.Epoch == current.Epoch && promise.Clock <= current.Clock && promise.Seq <= current.Seq {
+		return
+	}
+	s.promises[id] = promise
+	s.promisesVersion++
+}
+
+// mergePromises records the promises received from another node, and delivers
+// the messages that became stable. It must be called with msgsMu held.
+func (s *Server) mergePromises(promises map[string]Promise) {
+	version := s.promisesVersion
+	for id, promise := range promises {
+		s.setPromise(id, promise)
+	}
+	if s.promisesVersion != version {
+		s.deliverStable()
+	}
+}
+
+// copyPromises returns the promises to send to other nodes, or nil if we don't
+// need them. It must be called with msgsMu held.
+func (s *Server) copyPromises() map[string]Promise {
+	if s.config.Order != ORDER_TOTAL {
+		return nil
+	}
+	res := make(map[string]Promise, len(s.promises))
+	for id, promise := range s.promises {
+		res[id] = promise
+	}
+	return res
+}
+
+// deliverStable delivers the undelivered messages in timestamp order, as long
+// as they are stable, meaning that we know all the messages that come before
+// them. A message with timestamp t is stable if every node has promised that
+// its future messages have a timestamp greater than t, and we have all the
+// messages that it sent before the promise. This requires all nodes to be
+// alive, which is the price to pay for a total order without a leader. It
+// must be called with msgsMu held.
+func (s *Server) deliverStable() {
+	for s.undelivered.Len() > 0 {
+		next := s.undelivered[0]
+		for _, id := range s.members {
+			promise := s.promises[id]
+			if promise.Clock < next.Timestamp || s.originLog(originID(id, promise.Epoch)).contiguous < promise.Seq {
+				return
+			}
+		}
+		heap.Pop(&s.undelivered)
+		s.msgs.Add(next.Origin, next.Entry)
+	}
+}
+
+type undeliveredEntry struct {
+	Origin string
+	Entry
+}
+
+// undeliveredHeap sorts the messages by timestamp, breaking ties with the
+// origin, which gives the same order on every node.
+type undeliveredHeap []undeliveredEntry
+
+func (h undeliveredHeap) Len() int { return len(h) }
+
+func (h undeliveredHeap) Less(i, j int) bool {
+	if h[i].Timestamp != h[j].Timestamp {
+		return h[i].Timestamp < h[j].Timestamp
+	}
+	return h[i].Origin < h[j].Origin
+}
+
+func (h undeliveredHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *undeliveredHeap) Push(x any) { *h = append(*h, x.(undeliveredEntry)) }
+
+func (h *undeliveredHeap) Pop() any {
+	old := *h
+	res := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return res
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+const (
+	DEFAULT_MAX_PAYLOAD_SIZE = 64 * 1024
+	DEFAULT_MAX_SYNC_SIZE    = 256 * 1024
+)
+
+// canonicalPayload validates a payload received from a client, and encodes it
+// in a canonical form (no whitespace, sorted object keys), so that two
+// payloads with the same content have the same encoding and the same hash.
+// Numbers are kept as they are written, without converting them to float64.
+func canonicalPayload(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", errors.New("missing message")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// A PayloadSet contains distinct payloads in their canonical encoding, in the
+// order in which we added them. Payloads are deduplicated by their SHA-256
+// hash, so if two clients broadcast the same payload we only keep one copy,
+// like we did when all messages were integers.
+//
+// Every payload gets an index, starting from 1, which never changes even if
+// the garbage collector removes some of the previous payloads, so clients can
+// ask for the payloads after a given index.
+type PayloadSet struct {
+	// hashes maps the hash of every payload to its index.
+	hashes map[[sha256.Size]byte]int
+	items  []payloadItem
+	last   int
+}
+
+// A payloadItem remembers the origin and the sequence number of the payload,
+// so that the garbage collector can tell whether every node has it.
+type payloadItem struct {
+	index  int
+	data   json.RawMessage
+	origin string
+	entry  Entry
+}
+
+func NewPayloadSet() *PayloadSet {
+	return &PayloadSet{
+		hashes: make(map[[sha256.Size]byte]int),
+	}
+}
+
+// Add inserts the payload of an entry in the set, and returns false if it was
+// already there.
+func (p *PayloadSet) Add(origin string, entry Entry) bool {
+	hash := sha256.Sum256([]byte(entry.Data))
+	if _, ok := p.hashes[hash]; ok {
+		return false
+	}
+	p.last++
+	p.hashes[hash] = p.last
+	p.items = append(p.items, payloadItem{
+		index:  p.last,
+		data:   json.RawMessage(entry.Data),
+		origin: origin,
+		entry:  entry,
+	})
+	return true
+}
+
+func (p *PayloadSet) Contains(payload string) bool {
+	_, ok := p.hashes[sha256.Sum256([]byte(payload))]
+	return ok
+}
+
+// Get returns the origin and the entry of a payload.
+func (p *PayloadSet) Get(payload string) (string, Entry, bool) {
+	index, ok := p.hashes[sha256.Sum256([]byte(payload))]
+	if !ok {
+		return "", Entry{}, false
+	}
+	i := sort.Search(len(p.items), func(i int) bool {
+		return p.items[i].index >= index
+	})
+	return p.items[i].origin, p.items[i].entry, true
+}
+
+// Last returns the index of the last payload we added.
+func (p *PayloadSet) Last() int {
+	return p.last
+}
+
+// Since returns the payloads with index greater than index, except the ones
+// that expired before nowMillis (in Unix milliseconds).
+func (p *PayloadSet) Since(index int, nowMillis int64) []json.RawMessage {
+	start := sort.Search(len(p.items), func(i int) bool {
+		return p.items[i].index > index
+	})
+	res := make([]json.RawMessage, 0, len(p.items)-start)
+	for _, item := range p.items[start:] {
+		if item.entry.Expires == 0 || item.entry.Expires > nowMillis {
+			res = append(res, item.data)
+		}
+	}
+	return res
+}
+
+// Stable is like Since, but it stops at the first payload that is not covered
+// by stable, and it returns the index of the last payload that it returned
+// (or skipped because it expired), so that the client can continue from
+// there when more payloads become stable.
+func (p *PayloadSet) Stable(index int, nowMillis int64, stable VersionVector) ([]json.RawMessage, int) {
+	start := sort.Search(len(p.items), func(i int) bool {
+		return p.items[i].index > index
+	})
+	res := []json.RawMessage{}
+	last := index
+	for _, item := range p.items[start:] {
+		if item.entry.Seq > stable[item.origin] {
+			return res, last
+		}
+		if item.entry.Expires == 0 || item.entry.Expires > nowMillis {
+			res = append(res, item.data)
+		}
+		last = item.index
+	}
+	return res, p.last
+}
+
+// Expire removes the payloads that expired before nowMillis, if every node
+// has them according to stable. Otherwise we keep them, and the other nodes
+// can still get them through the sync rounds.
+func (p *PayloadSet) Expire(nowMillis int64, stable VersionVector) int {
+	kept := p.items[:0]
+	for _, item := range p.items {
+		expires := item.entry.Expires
+		if expires != 0 && expires <= nowMillis && item.entry.Seq <= stable[item.origin] {
+			delete(p.hashes, sha256.Sum256(item.data))
+			continue
+		}
+		kept = append(kept, item)
+	}
+	removed := len(p.items) - len(kept)
+	p.items = kept
+	return removed
+}
+
+// Each calls f on the entries of all the payloads, in order.
+func (p *PayloadSet) Each(f func(origin string, entry Entry)) {
+	for _, item := range p.items {
+		f(item.origin, item.entry)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// PLUMTREE_GRAFT_TIMEOUT is how long we wait for a message announced by a
+// neighbor to arrive through the tree, before asking the neighbor for it.
+const PLUMTREE_GRAFT_TIMEOUT = 500 * time.Millisecond
+
+// PlumtreeStrategy implements epidemic broadcast trees. Every node is
+// connected to the nodes at distance 1, 2, 4, 8, ... on a ring, so the overlay
+// has a small diameter and many redundant paths. At the beginning every link
+// is eager: new messages are pushed through it right away. When a node
+// receives a push for a message that it already has, the link is redundant,
+// so it prunes it: the link becomes lazy on both sides. After a few messages,
+// the eager links form a spanning tree, and every message is pushed about once
+// to every node.
+//
+// We build a separate tree for every origin. With a single tree, messages from
+// different origins that cross each other can prune different links of the
+// same cycle, and the tree keeps breaking apart and being repaired when many
+// nodes broadcast at the same time.
+//
+// The sync rounds only carry our version vector, which announces the messages
+// that we have (the IHAVE of the paper). If a node learns that a neighbor has
+// a message that didn't arrive through the tree within PLUMTREE_GRAFT_TIMEOUT,
+// a node of the tree must have failed (or the push got lost), so it grafts the
+// link: it becomes eager on both sides, and the neighbor sends the missing
+// messages, which we push down the tree. This repairs the tree around dead
+// nodes.
+//
+// The server calls the methods of the strategy while holding neighborsMu.
+type PlumtreeStrategy struct {
+	// lazy contains the lazy links of the tree of every origin.
+	lazy map[string]map[string]bool
+	// missing contains, for every origin, the highest sequence number that
+	// a neighbor announced and we don't have, and the last neighbor that
+	// announced it.
+	missing map[string]*plumtreeMissing
+}
+
+type plumtreeMissing struct {
+	seq   int
+	from  string
+	since time.Time
+}
+
+func NewPlumtreeStrategy() *PlumtreeStrategy {
+	return &PlumtreeStrategy{
+		lazy:    make(map[string]map[string]bool),
+		missing: make(map[string]*plumtreeMissing),
+	}
+}
+
+func (*PlumtreeStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	index := 0
+	for i, other := range nodeIDs {
+		if other == id {
+			index = i
+		}
+	}
+
+	size := len(nodeIDs)
+	res := []string{}
+	for distance := 1; distance < size; distance *= 2 {
+		for _, other := range []string{nodeIDs[(index+distance)%size], nodeIDs[(index-distance+size)%size]} {
+			if other != id && !contains(res, other) {
+				res = append(res, other)
+			}
+		}
+	}
+	return res
+}
+
+func (*PlumtreeStrategy) Targets(neighbors []string) []string {
+	return allTargets(neighbors)
+}
+
+func (p *PlumtreeStrategy) Lazy(neighbor, origin string) bool {
+	return p.lazy[origin][neighbor]
+}
+
+// Prune makes the link with neighbor lazy in the tree of origin, and returns
+// true if it was eager.
+func (p *PlumtreeStrategy) Prune(neighbor, origin string) bool {
+	if p.lazy[origin][neighbor] {
+		return false
+	}
+	if _, ok := p.lazy[origin]; !ok {
+		p.lazy[origin] = make(map[string]bool)
+	}
+	p.lazy[origin][neighbor] = true
+	return true
+}
+
+func (p *PlumtreeStrategy) Graft(neighbor, origin string) {
+	delete(p.lazy[origin], neighbor)
+}
+
+// Announce records the messages that a neighbor has and we miss, according to
+// its version vector. We graft the last neighbor that announced them, so that
+// if a neighbor dies before we graft it, we ask one that is still alive.
+func (p *PlumtreeStrategy) Announce(neighbor string, version, ours VersionVector) {
+	for origin, seq := range version {
+		if seq <= ours[origin] {
+			continue
+		}
+		if missing, ok := p.missing[origin]; ok {
+			if seq >= missing.seq {
+				missing.seq = seq
+				missing.from = neighbor
+			}
+			continue
+		}
+		p.missing[origin] = &plumtreeMissing{seq: seq, from: neighbor, since: time.Now()}
+	}
+}
+
+// Grafts returns, for every neighbor, the origins of the messages that it
+// announced and that are still missing after PLUMTREE_GRAFT_TIMEOUT, and
+// grafts the corresponding links. We skip the neighbors that we suspect, and
+// wait for another neighbor to announce the messages.
+func (p *PlumtreeStrategy) Grafts(ours VersionVector, suspected map[string]bool) map[string][]string {
+	res := map[string][]string{}
+	for origin, missing := range p.missing {
+		if ours[origin] >= missing.seq {
+			delete(p.missing, origin)
+			continue
+		}
+		if time.Since(missing.since) < PLUMTREE_GRAFT_TIMEOUT || suspected[missing.from] {
+			continue
+		}
+		// If the graft gets lost, we try again after another timeout.
+		missing.since = time.Now()
+		res[missing.from] = append(res[missing.from], origin)
+		p.Graft(missing.from, origin)
+	}
+	return res
+}
+
+// lazy returns true if we only announce the messages of origin to neighbor.
+// It must be called with neighborsMu held.
+func (s *Server) lazy(neighbor, origin string) bool {
+	plumtree, ok := s.strategy.(*PlumtreeStrategy)
+	return ok && plumtree.Lazy(neighbor, origin)
+}
+
+// announce must be called with neighborsMu held.
+func (s *Server) announce(neighbor string, version VersionVector) {
+	plumtree, ok := s.strategy.(*PlumtreeStrategy)
+	if !ok {
+		return
+	}
+	s.msgsMu.RLock()
+	ours := s.versionVector()
+	s.msgsMu.RUnlock()
+	plumtree.Announce(neighbor, version, ours)
+}
+
+// pushed updates the tree of origin after we receive a push from a neighbor:
+// if we already had the message the link is redundant and we prune it,
+// otherwise it is part of the tree.
+func (s *Server) pushed(from, origin string, added bool) {
+	plumtree, ok := s.strategy.(*PlumtreeStrategy)
+	if !ok {
+		return
+	}
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	if added {
+		plumtree.Graft(from, origin)
+	} else if plumtree.Prune(from, origin) {
+		s.n.Send(from, PruneInput{Type: "prune", Origin: origin})
+	}
+}
+
+// graftMissing asks the neighbors for the messages that they announced and
+// that didn't arrive in time.
+func (s *Server) graftMissing() {
+	plumtree, ok := s.strategy.(*PlumtreeStrategy)
+	if !ok {
+		return
+	}
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	s.msgsMu.RLock()
+	version := s.versionVector()
+	s.msgsMu.RUnlock()
+	for neighbor, origins := range plumtree.Grafts(version, s.suspected) {
+		log.Printf("grafting %v for %v", neighbor, origins)
+		s.n.Send(neighbor, GraftInput{Type: "graft", Origins: origins, Version: version})
+	}
+}
+
+type PruneInput struct {
+	Type   string `json:"type"`
+	Origin string `json:"origin"`
+}
+
+type GraftInput struct {
+	Type    string        `json:"type"`
+	Origins []string      `json:"origins"`
+	Version VersionVector `json:"version"`
+}
+
+// Prunes and grafts are sent without a msg_id, so their handlers never return
+// an error: the library would reply with an error message that the sender
+// has no handler for, and its Run would fail. They log the message and drop
+// it instead.
+func (s *Server) pruneHandler(msg maelstrom.Message) error {
+	var inputBody PruneInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		log.Printf("invalid prune from %v: %v", msg.Src, err)
+		return nil
+	}
+
+	plumtree, ok := s.strategy.(*PlumtreeStrategy)
+	if !ok {
+		log.Printf("ignoring prune from %v: only the plumtree strategy supports it", msg.Src)
+		return nil
+	}
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	plumtree.Prune(msg.Src, inputBody.Origin)
+	return nil
+}
+
+// graftHandler makes the links with the sender eager again, and sends it the
+// messages that it misses right away, without waiting for the next round.
+// Like in the sync rounds we only send the first chunk, and nothing if the
+// sender hasn't answered our previous sync: the sender grafts again if some
+// messages are still missing after PLUMTREE_GRAFT_TIMEOUT.
+func (s *Server) graftHandler(msg maelstrom.Message) error {
+	var inputBody GraftInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		log.Printf("invalid graft from %v: %v", msg.Src, err)
+		return nil
+	}
+
+	plumtree, ok := s.strategy.(*PlumtreeStrategy)
+	if !ok {
+		log.Printf("ignoring graft from %v: only the plumtree strategy supports it", msg.Src)
+		return nil
+	}
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	for _, origin := range inputBody.Origins {
+		plumtree.Graft(msg.Src, origin)
+	}
+	s.setAcks(msg.Src, inputBody.Version)
+	s.msgsMu.RLock()
+	chunks := s.chunks(inputBody.Version)
+	version := s.versionVector()
+	s.msgsMu.RUnlock()
+	if len(chunks) > 0 {
+		body := SyncInput{
+			Type:    "sync",
+			Version: version,
+		}
+		s.encodeMessages(msg.Src, &body, chunks[0])
+		s.sync(msg.Src, body)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// In eager mode, a node pushes every new message to its neighbors as soon as
+// it learns about it, and they forward it in the same way, so the message
+// floods the overlay without waiting for the sync rounds. Pushes are not
+// acknowledged: if one gets lost, the next sync with that neighbor notices
+// that it is missing the message and sends it again.
+type PushInput struct {
+	Type   string `json:"type"`
+	Origin string `json:"origin"`
+	Entry
+}
+
+// pushHandler never returns an error, since pushes don't have a msg_id: the
+// library would send the error to the sender as a message that it has no
+// handler for, and its Run would fail.
+func (s *Server) pushHandler(msg maelstrom.Message) error {
+	var inputBody PushInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		log.Printf("invalid push from %v: %v", msg.Src, err)
+		return nil
+	}
+	if !s.verify(msg.Src, inputBody.Origin, inputBody.Entry) {
+		return nil
+	}
+
+	s.msgsMu.Lock()
+	added := s.addEntry(inputBody.Origin, inputBody.Entry)
+	if added {
+		s.notifyNewMessages(1)
+	}
+	s.msgsMu.Unlock()
+
+	s.pushed(msg.Src, inputBody.Origin, added)
+	if added {
+		s.push(msg.Src, inputBody.Origin, inputBody.Entry)
+	}
+	return nil
+}
+
+// push sends a message to the neighbors chosen by the strategy, except from
+// (the node we received it from) and the nodes that already have it.
+//
+// We don't know for sure that a pushed message arrives, but we optimistically
+// advance the version vector of the destination, so that the sync rounds don't
+// send the message again. The next version vector we receive from the
+// destination replaces ours, and if the push got lost the message will be
+// sent again in the following sync. We can only advance a version vector if
+// the message is the next one of its origin, otherwise the sync rounds will
+// send it anyway.
+func (s *Server) push(from, origin string, entry Entry) {
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+
+	seq := entry.Seq
+	if acks, ok := s.neighborsAcks[from]; ok && acks[origin] == seq-1 {
+		acks[origin] = seq
+	}
+
+	body := PushInput{
+		Type:   "push",
+		Origin: origin,
+		Entry:  entry,
+	}
+	for _, neighbor := range s.strategy.Targets(s.activeNeighbors()) {
+		acks := s.neighborsAcks[neighbor]
+		if neighbor == from || acks[origin] >= seq || s.lazy(neighbor, origin) {
+			continue
+		}
+		if acks[origin] == seq-1 {
+			acks[origin] = seq
+		}
+		s.sent(neighbor)
+		s.n.Send(neighbor, body)
+	}
+}
+
+// pushAll pushes the messages that we received in a sync, in eager mode, so
+// that they keep flooding the overlay even if the pushes that should have
+// brought them got lost.
+func (s *Server) pushAll(from string, messages map[string][]Entry) {
+	if !s.config.Eager {
+		return
+	}
+	for origin, entries := range messages {
+		for _, entry := range entries {
+			s.push(from, origin, entry)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// RegionStrategy simulates a deployment over several regions, where the links
+// between regions are much slower (and more expensive) than the links inside
+// a region. Node nK belongs to region K % Regions (node IDs that don't have
+// this form are assigned by hash), so a node keeps its region when the
+// membership changes.
+//
+// Inside a region, the nodes use the Local strategy, restricted to the
+// members of the region: with the topology strategy, we keep the links of the
+// proposed topology between nodes of the same region, and we connect the
+// pieces if dropping the other links disconnected the region. Between two
+// regions there is a single link, so every message crosses it once per region
+// pair, and then fans out inside the region. The endpoints of the links are
+// spread over the members of the regions, so that a node doesn't become the
+// gateway for every other region. Local must not keep state about the
+// overlay, so the clusters, swim and plumtree strategies can't be used inside
+// a region.
+//
+// If a gateway fails, the detours around it include its own remote gateways,
+// so the stream between the two regions moves to another pair of nodes.
+type RegionStrategy struct {
+	Regions int
+	Local   Strategy
+}
+
+// region returns the region of a node.
+func (r RegionStrategy) region(id string) int {
+	if len(id) > 1 && id[0] == 'n' {
+		if index, err := strconv.Atoi(id[1:]); err == nil && index >= 0 {
+			return index % r.Regions
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(r.Regions))
+}
+
+// groups splits the nodes by region, keeping their order.
+func (r RegionStrategy) groups(nodeIDs []string) [][]string {
+	res := make([][]string, r.Regions)
+	for _, id := range nodeIDs {
+		region := r.region(id)
+		res[region] = append(res[region], id)
+	}
+	return res
+}
+
+func (r RegionStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	groups := r.groups(nodeIDs)
+	own := r.region(id)
+	local := groups[own]
+	if !contains(local, id) {
+		local = append(append([]string{}, local...), id)
+	}
+
+	res := []string{}
+	for _, neighbor := range r.Local.Neighbors(id, local, localTopology(local, topology)) {
+		if neighbor != id {
+			res = append(res, neighbor)
+		}
+	}
+	for region, members := range groups {
+		if region == own || len(members) == 0 {
+			continue
+		}
+		if gateway(local, region) == id {
+			res = append(res, gateway(members, own))
+		}
+	}
+	return res
+}
+
+func (r RegionStrategy) Targets(neighbors []string) []string {
+	return r.Local.Targets(neighbors)
+}
+
+// gateway returns the member of a region that keeps the link with the other
+// region. Both regions choose their endpoint in the same way, so they agree on
+// the link.
+func gateway(members []string, other int) string {
+	return members[other%len(members)]
+}
+
+// localTopology keeps the links of topology between the members of a region.
+// If the region is not connected anymore, we link the first node of every
+// other piece to the first node of the region.
+func localTopology(members []string, topology map[string][]string) map[string][]string {
+	res := make(map[string][]string, len(members))
+	for _, id := range members {
+		for _, neighbor := range topology[id] {
+			if contains(members, neighbor) {
+				res[id] = append(res[id], neighbor)
+			}
+		}
+	}
+
+	visited := make(map[string]bool, len(members))
+	var visit func(id string)
+	visit = func(id string) {
+		visited[id] = true
+		for _, neighbor := range res[id] {
+			if !visited[neighbor] {
+				visit(neighbor)
+			}
+		}
+	}
+	for _, id := range members {
+		if visited[id] {
+			continue
+		}
+		if id != members[0] {
+			res[id] = append(res[id], members[0])
+			res[members[0]] = append(res[members[0]], id)
+		}
+		visit(id)
+	}
+	return res
+}
+
+// remote returns true if neighbor is in another region.
+func (s *Server) remote(neighbor string) bool {
+	regions, ok := s.strategy.(RegionStrategy)
+	return ok && regions.region(neighbor) != regions.region(s.n.ID())
+}
+
+// sent counts the messages that we send to other regions.
+func (s *Server) sent(neighbor string) {
+	if s.remote(neighbor) {
+		s.crossRegion.Add(1)
+	}
+}
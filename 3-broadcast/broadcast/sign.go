@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// KEY_PREFIX is the prefix of the lin-kv keys that contain the public keys of
+// the origins.
+const KEY_PREFIX = "broadcast_key_"
+
+// In signed mode, every origin signs its messages with an ed25519 key, so that
+// a node can't forge or alter the messages of another origin: the other nodes
+// drop every entry whose signature doesn't match, wherever it comes from.
+//
+// Maelstrom doesn't let us give each node its own key, so every node creates a
+// key pair at init and publishes the public key of its origin in lin-kv. The
+// compare-and-swap only creates the key if it doesn't exist, so once an origin
+// has a key nobody can replace it. With BROADCAST_STORE_DIR the private key is
+// saved next to the log, so that a restarted node keeps signing with the same
+// key. Without it a restarted node has a new key, but it also has a new origin,
+// since the origin contains the epoch, and the keys of its older origins still
+// verify the messages that it signed before.
+
+// signedEntry contains the fields of an entry that are covered by the
+// signature, together with its origin.
+type signedEntry struct {
+	Origin    string `json:"origin"`
+	Seq       int    `json:"seq"`
+	Data      string `json:"data"`
+	Timestamp int    `json:"ts"`
+	Expires   int64  `json:"expires"`
+}
+
+func signedBytes(origin string, entry Entry) []byte {
+	buf, _ := json.Marshal(signedEntry{
+		Origin:    origin,
+		Seq:       entry.Seq,
+		Data:      entry.Data,
+		Timestamp: entry.Timestamp,
+		Expires:   entry.Expires,
+	})
+	return buf
+}
+
+// setupKey loads or creates our private key, and publishes the public key of
+// our origin. It must be called after we choose our origin.
+func (s *Server) setupKey() error {
+	key, err := loadKey(s.config.StoreDir, s.n.ID())
+	if err != nil {
+		return err
+	}
+	public := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+	if err := s.kv.CompareAndSwap(ctx, KEY_PREFIX+s.origin, public, public, true); err != nil {
+		return fmt.Errorf("publishing the public key: %w", err)
+	}
+	s.key = key
+	return nil
+}
+
+// loadKey reads the private key from dir, or creates a new one (and saves it,
+// if dir is not "").
+func loadKey(dir, node string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, node+".key")
+	if dir != "" {
+		seed, err := os.ReadFile(path)
+		if err == nil && len(seed) == ed25519.SeedSize {
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := os.WriteFile(path, key.Seed(), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// sign sets the signature of an entry that we created.
+func (s *Server) sign(entry *Entry) {
+	if s.key != nil {
+		entry.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, signedBytes(s.origin, *entry)))
+	}
+}
+
+// publicKey returns the public key of an origin, reading it from lin-kv the
+// first time.
+func (s *Server) publicKey(origin string) (ed25519.PublicKey, error) {
+	s.keysMu.Lock()
+	key, ok := s.keys[origin]
+	s.keysMu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+	var encoded string
+	if err := s.kv.ReadInto(ctx, KEY_PREFIX+origin, &encoded); err != nil {
+		return nil, err
+	}
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(buf) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", encoded)
+	}
+	key = ed25519.PublicKey(buf)
+	s.keysMu.Lock()
+	s.keys[origin] = key
+	s.keysMu.Unlock()
+	return key, nil
+}
+
+// verify returns false if the signature of an entry is wrong. If we can't get
+// the public key of the origin we can't tell, so we return false without
+// counting the entry as forged: we will receive it again in a later sync.
+func (s *Server) verify(from, origin string, entry Entry) bool {
+	if !s.config.Signed {
+		return true
+	}
+	key, err := s.publicKey(origin)
+	if err != nil {
+		log.Printf("can't get the public key of %v: %v", origin, err)
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(entry.Signature)
+	if err != nil || !ed25519.Verify(key, signedBytes(origin, entry), signature) {
+		s.rejected.Add(1)
+		log.Printf("rejecting message %v of %v from %v: invalid signature", entry.Seq, origin, from)
+		return false
+	}
+	return true
+}
+
+// verifyMessages returns the messages with a valid signature. It must be
+// called without holding any lock, since it can read the keys from lin-kv.
+func (s *Server) verifyMessages(from string, messages map[string][]Entry) map[string][]Entry {
+	if !s.config.Signed {
+		return messages
+	}
+	res := make(map[string][]Entry, len(messages))
+	for origin, entries := range messages {
+		for _, entry := range entries {
+			if s.verify(from, origin, entry) {
+				res[origin] = append(res[origin], entry)
+			}
+		}
+	}
+	return res
+}
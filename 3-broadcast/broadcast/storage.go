@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// SNAPSHOT_INTERVAL is the interval between two snapshots, if something
+	// changed in the meantime.
+	SNAPSHOT_INTERVAL = 10 * time.Second
+	// EPOCH_PREFIX is the prefix of the lin-kv keys that contain the last
+	// epoch of the nodes that don't persist their state.
+	EPOCH_PREFIX = "broadcast_epoch_"
+)
+
+// A Record is a change of the state of a node: either a new message of an
+// origin, or a new version vector of a neighbor.
+type Record struct {
+	Origin   string        `json:"origin,omitempty"`
+	Entry    *Entry        `json:"entry,omitempty"`
+	Neighbor string        `json:"neighbor,omitempty"`
+	Acks     VersionVector `json:"acks,omitempty"`
+}
+
+// A Snapshot contains the whole state of a node as a list of records, plus
+// the sequence numbers up to which the garbage collector compacted each
+// origin log.
+type Snapshot struct {
+	Bases   map[string]int `json:"bases"`
+	Records []Record       `json:"records"`
+}
+
+// A Storage persists the state of a node, so that after a restart it only
+// needs to receive the messages that it missed while it was down.
+type Storage interface {
+	// Load returns the last snapshot (nil if there is none), and the records
+	// appended after it.
+	Load() (*Snapshot, []Record, error)
+	// Append adds a record after the last snapshot.
+	Append(record Record) error
+	// WriteSnapshot replaces the last snapshot, and removes the records
+	// appended after the old one.
+	WriteSnapshot(snapshot *Snapshot) error
+}
+
+// FileStorage keeps the records in an append-only file, one JSON record per
+// line, and the snapshot in another file. Appends are not fsynced: this
+// protects us from crashes of the process, which is what maelstrom
+// simulates, but not from crashes of the machine. Snapshots are written
+// atomically like in the unique ids challenge.
+type FileStorage struct {
+	logPath      string
+	snapshotPath string
+	file         *os.File
+	mu           sync.Mutex
+}
+
+func NewFileStorage(dir, nodeID string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	logPath := filepath.Join(dir, nodeID+".log")
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{
+		logPath:      logPath,
+		snapshotPath: filepath.Join(dir, nodeID+".snapshot"),
+		file:         f,
+	}, nil
+}
+
+func (f *FileStorage) Load() (*Snapshot, []Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var snapshot *Snapshot
+	data, err := os.ReadFile(f.snapshotPath)
+	if err == nil {
+		snapshot = &Snapshot{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, nil, fmt.Errorf("corrupted snapshot %v: %w", f.snapshotPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	data, err = os.ReadFile(f.logPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := []Record{}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			// The last line can be incomplete if we crashed while
+			// writing it.
+			log.Printf("storage: ignoring corrupted record: %v", err)
+			break
+		}
+		records = append(records, record)
+	}
+	return snapshot, records, nil
+}
+
+func (f *FileStorage) Append(record Record) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(buf, '\n'))
+	return err
+}
+
+func (f *FileStorage) WriteSnapshot(snapshot *Snapshot) error {
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// If we crash after the rename but before the truncation, the next
+	// Load returns records that are already in the snapshot, but replaying
+	// them is harmless.
+	tmp := f.snapshotPath + ".tmp"
+	if err := writeAndSync(tmp, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.snapshotPath); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(f.snapshotPath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return err
+	}
+	return f.file.Truncate(0)
+}
+
+func writeAndSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// appendRecord must be called with msgsMu or neighborsMu held, depending on
+// the record, so that the record can't end up in the log after a snapshot
+// that already contains it.
+func (s *Server) appendRecord(record Record) {
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.Append(record); err != nil {
+		log.Printf("storage: %v", err)
+	}
+	s.unsaved.Add(1)
+}
+
+// nextEpoch increments our epoch in lin-kv, and returns it. The first time
+// the key doesn't exist, and we create it with epoch 0.
+func (s *Server) nextEpoch() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KV_TIMEOUT)
+	defer cancel()
+	key := EPOCH_PREFIX + s.n.ID()
+	epoch := 0
+	err := s.kv.CompareAndSwap(ctx, key, -1, epoch, true)
+	for err != nil {
+		if rpcErr, ok := err.(*maelstrom.RPCError); !ok || rpcErr.Code != maelstrom.PreconditionFailed {
+			return 0, fmt.Errorf("taking a new epoch: %w", err)
+		}
+		// The key exists, or somebody changed it in the meantime.
+		if epoch, err = s.kv.ReadInt(ctx, key); err != nil {
+			return 0, fmt.Errorf("taking a new epoch: %w", err)
+		}
+		epoch++
+		err = s.kv.CompareAndSwap(ctx, key, epoch-1, epoch, false)
+	}
+	return epoch, nil
+}
+
+// restore rebuilds the state of the node from the storage. It must be called
+// before s.storage is set, so that we don't append the records again.
+func (s *Server) restore(storage Storage) error {
+	snapshot, records, err := storage.Load()
+	if err != nil {
+		return err
+	}
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	s.msgsMu.Lock()
+	defer s.msgsMu.Unlock()
+	s.applySnapshot(snapshot, records)
+	log.Printf("storage: restored %d messages", s.msgs.Last())
+	return nil
+}
+
+// applySnapshot adds the state contained in a snapshot (if not nil) and in
+// the following records to the state of the node. It must be called with
+// neighborsMu and msgsMu held.
+func (s *Server) applySnapshot(snapshot *Snapshot, records []Record) {
+	if snapshot != nil {
+		for origin, base := range snapshot.Bases {
+			s.originLog(origin).Skip(base)
+			// The garbage collector may have removed all our messages,
+			// but we must not reuse their sequence numbers.
+			if origin == s.origin && base > s.seq {
+				s.seq = base
+			}
+		}
+		records = append(snapshot.Records, records...)
+	}
+	for _, record := range records {
+		if record.Entry != nil {
+			s.restoreEntry(record.Origin, *record.Entry)
+		}
+		if record.Neighbor != "" {
+			s.setAcks(record.Neighbor, record.Acks)
+		}
+	}
+}
+
+// restoreEntry must be called with msgsMu held.
+func (s *Server) restoreEntry(origin string, entry Entry) {
+	if origin == s.origin && entry.Seq > s.seq {
+		s.seq = entry.Seq
+	}
+	if entry.Seq > s.originLog(origin).base {
+		s.addEntry(origin, entry)
+		return
+	}
+	// The garbage collector removed the entry from the log, but we still
+	// need to deliver it.
+	s.deliverEntry(origin, entry)
+}
+
+// snapshot replaces the records in the storage with a snapshot of the current
+// state. We hold both locks while we write it, so that no record is appended
+// in the meantime.
+func (s *Server) snapshot() error {
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	s.msgsMu.Lock()
+	defer s.msgsMu.Unlock()
+	if s.unsaved.Load() == 0 {
+		return nil
+	}
+	snapshot := s.buildSnapshot(true)
+	if err := s.storage.WriteSnapshot(snapshot); err != nil {
+		return err
+	}
+	s.unsaved.Store(0)
+	return nil
+}
+
+// buildSnapshot returns a snapshot of the messages of the node and, if
+// withAcks is true, of the version vectors of its neighbors. It must be called
+// with neighborsMu and msgsMu held.
+func (s *Server) buildSnapshot(withAcks bool) *Snapshot {
+	snapshot := &Snapshot{
+		Bases:   make(map[string]int),
+		Records: []Record{},
+	}
+	type key struct {
+		origin string
+		seq    int
+	}
+	saved := make(map[key]bool)
+	add := func(origin string, entry Entry) {
+		if !saved[key{origin, entry.Seq}] {
+			saved[key{origin, entry.Seq}] = true
+			snapshot.Records = append(snapshot.Records, Record{Origin: origin, Entry: &entry})
+		}
+	}
+
+	// We save the delivered messages first, so that after a restart they
+	// are delivered in the same order.
+	s.msgs.Each(add)
+	for origin, originLog := range s.logs {
+		snapshot.Bases[origin] = originLog.base
+		for _, entry := range originLog.After(originLog.base) {
+			add(origin, entry)
+		}
+	}
+	for _, undelivered := range s.undelivered {
+		add(undelivered.Origin, undelivered.Entry)
+	}
+	if withAcks {
+		for neighbor, acks := range s.neighborsAcks {
+			snapshot.Records = append(snapshot.Records, Record{Neighbor: neighbor, Acks: acks.Copy()})
+		}
+	}
+	return snapshot
+}
+
+func (s *Server) snapshotLoop(done <-chan struct{}) {
+	t := time.NewTicker(SNAPSHOT_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.snapshot(); err != nil {
+				log.Printf("storage: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+const (
+	STRATEGY_TOPOLOGY = "topology"
+	STRATEGY_STAR     = "star"
+	STRATEGY_CLUSTERS = "clusters"
+	STRATEGY_TREE     = "tree"
+	STRATEGY_EPIDEMIC = "epidemic"
+	STRATEGY_MESH     = "mesh"
+	STRATEGY_SWIM     = "swim"
+	STRATEGY_PLUMTREE = "plumtree"
+
+	// DEFAULT_CLUSTER_SIZE is the default number of nodes in each cluster of
+	// the clusters strategy, master included.
+	DEFAULT_CLUSTER_SIZE = 5
+	// TREE_FANOUT is the number of children of each node in the tree strategy.
+	TREE_FANOUT = 4
+	// EPIDEMIC_FANOUT is the number of random nodes that we sync with at
+	// every round in the epidemic strategy.
+	EPIDEMIC_FANOUT = 3
+)
+
+// A Strategy decides the shape of the gossip overlay.
+type Strategy interface {
+	// Neighbors returns the nodes that id can sync with. It is called when we
+	// receive the topology message, which contains the topology proposed by
+	// maelstrom, and every time the membership changes. nodeIDs contains the
+	// current members. If the strategy is not a FailoverStrategy, we also
+	// call it with the ID of other nodes to find detours around them, so it
+	// must not have side effects.
+	Neighbors(id string, nodeIDs []string, topology map[string][]string) []string
+	// Targets chooses which of the neighbors we sync with in the next round.
+	Targets(neighbors []string) []string
+}
+
+// A FailoverStrategy can change the overlay when the failure detector
+// suspects a neighbor. The server calls its methods while holding
+// neighborsMu, so it can keep some state without further locking.
+type FailoverStrategy interface {
+	Strategy
+	// Failover is called when the failure detector starts suspecting the
+	// failed neighbor, and returns our new neighbors.
+	Failover(id string, neighbors []string, failed string) []string
+}
+
+func NewStrategy(config Config) (Strategy, error) {
+	strategy, err := newLocalStrategy(config)
+	if err != nil || config.Regions <= 1 {
+		return strategy, err
+	}
+	return RegionStrategy{Regions: config.Regions, Local: strategy}, nil
+}
+
+// newLocalStrategy returns the strategy that we use inside a region.
+func newLocalStrategy(config Config) (Strategy, error) {
+	switch config.Strategy {
+	case STRATEGY_TOPOLOGY:
+		return TopologyStrategy{}, nil
+	case STRATEGY_STAR:
+		return StarStrategy{}, nil
+	case STRATEGY_CLUSTERS:
+		return &ClustersStrategy{ClusterSize: config.ClusterSize}, nil
+	case STRATEGY_TREE:
+		return TreeStrategy{Fanout: TREE_FANOUT}, nil
+	case STRATEGY_EPIDEMIC:
+		return EpidemicStrategy{Fanout: EPIDEMIC_FANOUT}, nil
+	case STRATEGY_MESH:
+		return MeshStrategy{}, nil
+	case STRATEGY_SWIM:
+		return NewSwimStrategy(), nil
+	case STRATEGY_PLUMTREE:
+		return NewPlumtreeStrategy(), nil
+	default:
+		return nil, fmt.Errorf("unknown BROADCAST_STRATEGY %q", config.Strategy)
+	}
+}
+
+// allTargets is the Targets implementation of the strategies that sync with
+// all of their neighbors at every round.
+func allTargets(neighbors []string) []string {
+	return neighbors
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// others returns all the node IDs except id.
+func others(id string, nodeIDs []string) []string {
+	res := []string{}
+	for _, other := range nodeIDs {
+		if other != id {
+			res = append(res, other)
+		}
+	}
+	return res
+}
+
+// TopologyStrategy uses the topology given to us by maelstrom, without the
+// nodes that left. The nodes that joined later are not in the topology, so
+// they connect to the first node.
+type TopologyStrategy struct{}
+
+func (TopologyStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	res := []string{}
+	for _, neighbor := range topology[id] {
+		if contains(nodeIDs, neighbor) {
+			res = append(res, neighbor)
+		}
+	}
+	if len(res) == 0 {
+		if others := others(id, nodeIDs); len(others) > 0 {
+			res = append(res, others[0])
+		}
+	}
+	return res
+}
+
+func (TopologyStrategy) Targets(neighbors []string) []string {
+	return allTargets(neighbors)
+}
+
+// StarStrategy ignores the proposed topology, and chooses a single node as the
+// master: the master communicates with everybody, while all other nodes only
+// communicate with the master.
+type StarStrategy struct{}
+
+func (StarStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	master := nodeIDs[0]
+	if id == master {
+		return others(id, nodeIDs)
+	}
+	return []string{master}
+}
+
+func (StarStrategy) Targets(neighbors []string) []string {
+	return allTargets(neighbors)
+}
+
+// ClustersStrategy splits the nodes into clusters of ClusterSize nodes. The
+// first node of each cluster is its master: the masters are fully connected
+// to each other, while the other nodes only communicate with the master of
+// their cluster.
+//
+// If the failure detector suspects the master of our cluster, we consider it
+// dead and the next node of the cluster becomes the master. All the slaves
+// make the same choice independently, and the new master promotes itself when
+// it notices the failure too. The other masters learn about the new master
+// when it starts syncing with them.
+type ClustersStrategy struct {
+	ClusterSize int
+
+	// cluster is the cluster of the local node, masters contains the initial
+	// masters of all clusters, and failed the members of our cluster that
+	// we consider dead.
+	cluster []string
+	masters []string
+	failed  map[string]bool
+}
+
+func (c *ClustersStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	c.masters = []string{}
+	c.failed = make(map[string]bool)
+	for start := 0; start < len(nodeIDs); start += c.ClusterSize {
+		end := start + c.ClusterSize
+		if end > len(nodeIDs) {
+			end = len(nodeIDs)
+		}
+		c.masters = append(c.masters, nodeIDs[start])
+		for _, other := range nodeIDs[start:end] {
+			if other == id {
+				c.cluster = nodeIDs[start:end]
+			}
+		}
+	}
+	return c.neighbors(id)
+}
+
+// master returns the first member of our cluster that is not dead.
+func (c *ClustersStrategy) master() string {
+	for _, member := range c.cluster {
+		if !c.failed[member] {
+			return member
+		}
+	}
+	return ""
+}
+
+func (c *ClustersStrategy) neighbors(id string) []string {
+	master := c.master()
+	if id != master {
+		return []string{master}
+	}
+	res := []string{}
+	for _, other := range c.masters {
+		if other != id && !c.failed[other] {
+			res = append(res, other)
+		}
+	}
+	for _, member := range c.cluster {
+		if member != id && !c.failed[member] {
+			res = append(res, member)
+		}
+	}
+	return res
+}
+
+func (c *ClustersStrategy) Failover(id string, neighbors []string, failed string) []string {
+	if failed != c.master() {
+		// Nothing to do if a slave or the master of another cluster fails:
+		// we just keep trying to sync with them.
+		return neighbors
+	}
+	c.failed[failed] = true
+	log.Printf("master %v is not responding, promoting %v", failed, c.master())
+
+	// We keep the neighbors that we learned about in the meantime (for
+	// example the masters that replaced the failed ones in other clusters).
+	res := c.neighbors(id)
+	for _, neighbor := range neighbors {
+		if neighbor != failed && !contains(res, neighbor) && neighbor != id {
+			res = append(res, neighbor)
+		}
+	}
+	return res
+}
+
+func (*ClustersStrategy) Targets(neighbors []string) []string {
+	return allTargets(neighbors)
+}
+
+// TreeStrategy arranges the nodes in a balanced tree where every node has
+// Fanout children, and every node communicates with its parent and its
+// children.
+type TreeStrategy struct {
+	Fanout int
+}
+
+func (t TreeStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	index := 0
+	for i, other := range nodeIDs {
+		if other == id {
+			index = i
+		}
+	}
+
+	res := []string{}
+	if index > 0 {
+		res = append(res, nodeIDs[(index-1)/t.Fanout])
+	}
+	for child := index*t.Fanout + 1; child <= index*t.Fanout+t.Fanout && child < len(nodeIDs); child++ {
+		res = append(res, nodeIDs[child])
+	}
+	return res
+}
+
+func (TreeStrategy) Targets(neighbors []string) []string {
+	return allTargets(neighbors)
+}
+
+// EpidemicStrategy can communicate with every node, but at every round it
+// only syncs with Fanout random nodes.
+type EpidemicStrategy struct {
+	Fanout int
+}
+
+func (EpidemicStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	return others(id, nodeIDs)
+}
+
+func (e EpidemicStrategy) Targets(neighbors []string) []string {
+	if len(neighbors) <= e.Fanout {
+		return neighbors
+	}
+	res := make([]string, 0, e.Fanout)
+	for _, i := range rand.Perm(len(neighbors))[:e.Fanout] {
+		res = append(res, neighbors[i])
+	}
+	return res
+}
+
+// MeshStrategy syncs with every other node at every round.
+type MeshStrategy struct{}
+
+func (MeshStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	return others(id, nodeIDs)
+}
+
+func (MeshStrategy) Targets(neighbors []string) []string {
+	return allTargets(neighbors)
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	SWIM_ALIVE   = "alive"
+	SWIM_SUSPECT = "suspect"
+	SWIM_DEAD    = "dead"
+
+	// SWIM_FANOUT is the number of random members that we push new messages
+	// to in eager mode.
+	SWIM_FANOUT = 3
+	// SWIM_INDIRECT_PROBES is the number of members that we ask to ping a
+	// member that didn't answer our ping.
+	SWIM_INDIRECT_PROBES = 3
+	// Every membership update is piggybacked on SWIM_RETRANSMIT_MULT *
+	// log(nodes) messages, and a suspected member is declared dead after
+	// SWIM_SUSPICION_MULT * log(nodes) protocol periods.
+	SWIM_RETRANSMIT_MULT = 3
+	SWIM_SUSPICION_MULT  = 4
+	// SWIM_MAX_UPDATES is the maximum number of membership updates that we
+	// piggyback on a single message.
+	SWIM_MAX_UPDATES = 16
+)
+
+// SwimStrategy implements the SWIM protocol. Instead of syncing with fixed
+// neighbors, at every protocol period (see swimPeriod) a node pings a single
+// member, chosen in round-robin order, and the ping carries the messages that
+// the member is missing. The member replies with the messages that we are
+// missing, so the messages spread like in a push-pull epidemic, and every node
+// sends and receives about one ping per period, no matter how many nodes there
+// are.
+//
+// If the member doesn't answer, we ask SWIM_INDIRECT_PROBES other members to
+// ping it for us, and if nobody gets an answer we suspect it. The suspicion
+// spreads by piggybacking on the pings, and if the member doesn't refute it
+// in time we declare it dead. A member refutes a suspicion by increasing its
+// incarnation number: updates with a higher incarnation override the older
+// ones. Our neighbors are all the members that are not dead.
+//
+// The server calls the methods of the strategy while holding neighborsMu.
+type SwimStrategy struct {
+	Fanout int
+
+	id          string
+	incarnation int
+	members     map[string]*swimMember
+	// probes contains the members that we still have to ping in the current
+	// round, and updates the membership updates that we are piggybacking.
+	probes  []string
+	updates []*swimBroadcast
+}
+
+type swimMember struct {
+	status      string
+	incarnation int
+	since       time.Time
+}
+
+// A SwimUpdate says that a node has a given status, as far as the sender
+// knows.
+type SwimUpdate struct {
+	Node        string `json:"node"`
+	Status      string `json:"status"`
+	Incarnation int    `json:"incarnation"`
+}
+
+type swimBroadcast struct {
+	update        SwimUpdate
+	transmissions int
+}
+
+func NewSwimStrategy() *SwimStrategy {
+	return &SwimStrategy{
+		Fanout:  SWIM_FANOUT,
+		members: make(map[string]*swimMember),
+	}
+}
+
+// Neighbors is called when the membership changes: new members start alive,
+// and the ones that left are forgotten.
+func (w *SwimStrategy) Neighbors(id string, nodeIDs []string, topology map[string][]string) []string {
+	w.id = id
+	for _, other := range others(id, nodeIDs) {
+		if _, ok := w.members[other]; !ok {
+			w.members[other] = &swimMember{status: SWIM_ALIVE, since: time.Now()}
+		}
+	}
+	for member := range w.members {
+		if !contains(nodeIDs, member) {
+			delete(w.members, member)
+		}
+	}
+	return w.live()
+}
+
+func (w *SwimStrategy) Targets(neighbors []string) []string {
+	return EpidemicStrategy{Fanout: w.Fanout}.Targets(neighbors)
+}
+
+// live returns the members that are not dead.
+func (w *SwimStrategy) live() []string {
+	res := []string{}
+	for member, state := range w.members {
+		if state.status != SWIM_DEAD {
+			res = append(res, member)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// logSize returns the base 2 logarithm of the number of nodes, rounded up.
+func (w *SwimStrategy) logSize() int {
+	res := 1
+	for 1<<res < len(w.members)+1 {
+		res++
+	}
+	return res
+}
+
+// Apply merges an update that we received or generated, and returns true if
+// the set of live members changed.
+func (w *SwimStrategy) Apply(update SwimUpdate) bool {
+	if update.Node == w.id {
+		if update.Status != SWIM_ALIVE && update.Incarnation >= w.incarnation {
+			w.incarnation = update.Incarnation + 1
+			log.Printf("refuting %v with incarnation %v", update.Status, w.incarnation)
+			w.enqueue(SwimUpdate{Node: w.id, Status: SWIM_ALIVE, Incarnation: w.incarnation})
+		}
+		return false
+	}
+	member, ok := w.members[update.Node]
+	if !ok {
+		return false
+	}
+	newer := update.Incarnation > member.incarnation
+	same := update.Incarnation == member.incarnation
+	switch update.Status {
+	case SWIM_ALIVE:
+		if !newer {
+			return false
+		}
+	case SWIM_SUSPECT:
+		if !newer && !(same && member.status == SWIM_ALIVE) {
+			return false
+		}
+	case SWIM_DEAD:
+		if !newer && !(same && member.status != SWIM_DEAD) {
+			return false
+		}
+	default:
+		return false
+	}
+
+	wasLive := member.status != SWIM_DEAD
+	if member.status != update.Status {
+		log.Printf("%v is %v", update.Node, update.Status)
+	}
+	member.status = update.Status
+	member.incarnation = update.Incarnation
+	member.since = time.Now()
+	w.enqueue(update)
+	return wasLive != (member.status != SWIM_DEAD)
+}
+
+// Suspect is called when neither we nor the members we asked could ping a
+// member.
+func (w *SwimStrategy) Suspect(node string) bool {
+	member, ok := w.members[node]
+	if !ok || member.status != SWIM_ALIVE {
+		return false
+	}
+	return w.Apply(SwimUpdate{Node: node, Status: SWIM_SUSPECT, Incarnation: member.incarnation})
+}
+
+// Expire declares dead the members that have been suspected for longer than
+// SWIM_SUSPICION_MULT * log(nodes) periods, and returns true if the set of
+// live members changed.
+func (w *SwimStrategy) Expire(period time.Duration) bool {
+	timeout := time.Duration(SWIM_SUSPICION_MULT*w.logSize()) * period
+	changed := false
+	for node, member := range w.members {
+		if member.status == SWIM_SUSPECT && time.Since(member.since) > timeout {
+			if w.Apply(SwimUpdate{Node: node, Status: SWIM_DEAD, Incarnation: member.incarnation}) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// enqueue starts piggybacking an update, replacing the older updates about the
+// same node.
+func (w *SwimStrategy) enqueue(update SwimUpdate) {
+	kept := w.updates[:0]
+	for _, b := range w.updates {
+		if b.update.Node != update.Node {
+			kept = append(kept, b)
+		}
+	}
+	w.updates = append(kept, &swimBroadcast{update: update})
+}
+
+// Piggyback returns the updates to attach to a message for node, preferring
+// the ones that we sent fewer times. If we don't think that node is alive, we
+// also tell it, so that it can refute the suspicion.
+func (w *SwimStrategy) Piggyback(node string) []SwimUpdate {
+	res := []SwimUpdate{}
+	if member, ok := w.members[node]; ok && member.status != SWIM_ALIVE {
+		res = append(res, SwimUpdate{Node: node, Status: member.status, Incarnation: member.incarnation})
+	}
+
+	sort.SliceStable(w.updates, func(i, j int) bool {
+		return w.updates[i].transmissions < w.updates[j].transmissions
+	})
+	limit := SWIM_RETRANSMIT_MULT * w.logSize()
+	kept := w.updates[:0]
+	for _, b := range w.updates {
+		if len(res) < SWIM_MAX_UPDATES {
+			res = append(res, b.update)
+			b.transmissions++
+		}
+		if b.transmissions < limit {
+			kept = append(kept, b)
+		}
+	}
+	w.updates = kept
+	return res
+}
+
+// NextProbe returns the member to ping in this period. We go through the
+// members in a random order, and shuffle them again at the end of every
+// round. Dead members are pinged too, so that we find out if they come back,
+// for example when a partition heals.
+func (w *SwimStrategy) NextProbe() string {
+	for {
+		if len(w.probes) == 0 {
+			for member := range w.members {
+				w.probes = append(w.probes, member)
+			}
+			if len(w.probes) == 0 {
+				return ""
+			}
+			rand.Shuffle(len(w.probes), func(i, j int) {
+				w.probes[i], w.probes[j] = w.probes[j], w.probes[i]
+			})
+		}
+		probe := w.probes[0]
+		w.probes = w.probes[1:]
+		if _, ok := w.members[probe]; ok {
+			return probe
+		}
+	}
+}
+
+// Status returns the status of a member, or "" if it is not a member.
+func (w *SwimStrategy) Status(node string) string {
+	if member, ok := w.members[node]; ok {
+		return member.status
+	}
+	return ""
+}
+
+// Helpers returns up to count random live members, except node, to ping node
+// for us.
+func (w *SwimStrategy) Helpers(node string, count int) []string {
+	candidates := []string{}
+	for _, member := range w.live() {
+		if member != node && w.members[member].status == SWIM_ALIVE {
+			candidates = append(candidates, member)
+		}
+	}
+	return EpidemicStrategy{Fanout: count}.Targets(candidates)
+}
+
+// A ping is a sync that also carries membership updates, and like a sync to a
+// detour its reply carries the messages that the sender is missing. Pings and
+// ping_reqs are sent without a msg_id, like the syncs: a dead or partitioned
+// member never answers, and the library would keep the callback of every rpc
+// that we send it. SyncID identifies the ping, and the ping_ok echoes it.
+type PingInput struct {
+	SyncInput
+	Updates []SwimUpdate `json:"updates,omitempty"`
+}
+
+type PingOutput struct {
+	SyncOutput
+	Updates []SwimUpdate `json:"updates,omitempty"`
+}
+
+// A ping_req asks a member to ping Target for us. SyncID is the id of our
+// ping, and the member echoes both in the ping_req_ok if Target answers.
+type PingReqInput struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	SyncID int    `json:"sync_id"`
+}
+
+type PingReqOutput struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	SyncID int    `json:"sync_id"`
+}
+
+// pendingPing is a ping that its target hasn't answered yet. done is closed
+// when the target answers it, directly or through a ping_req.
+type pendingPing struct {
+	id   int
+	sent time.Time
+	done chan struct{}
+}
+
+// swimPeriod returns the protocol period. It is SyncTimeout, unless that is
+// too short to finish a probe before the next one starts: the direct ping
+// takes up to PingTimeout, and the indirect one up to twice as much, because
+// the ping_req and its reply add a round trip.
+func (s *Server) swimPeriod() time.Duration {
+	period := 3 * s.config.PingTimeout
+	if s.config.SyncTimeout > period {
+		period = s.config.SyncTimeout
+	}
+	return period
+}
+
+// swimLoop starts a probe every protocol period.
+func (s *Server) swimLoop(swim *SwimStrategy, done <-chan struct{}) {
+	period := s.swimPeriod()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.msgsMu.Lock()
+			s.pending = 0
+			s.msgsMu.Unlock()
+
+			s.neighborsMu.Lock()
+			if swim.Expire(period) {
+				s.setNeighbors(swim.live())
+			}
+			target := swim.NextProbe()
+			s.neighborsMu.Unlock()
+			if target != "" {
+				go s.probe(swim, target)
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// probe pings target, directly and then through other members, and suspects
+// it if nobody gets an answer.
+func (s *Server) probe(swim *SwimStrategy, target string) {
+	s.neighborsMu.Lock()
+	ping := s.ping(swim, target)
+	s.neighborsMu.Unlock()
+	if s.answered(ping, s.config.PingTimeout) {
+		return
+	}
+
+	s.neighborsMu.Lock()
+	s.lost(target)
+	status := swim.Status(target)
+	helpers := swim.Helpers(target, SWIM_INDIRECT_PROBES)
+	s.neighborsMu.Unlock()
+	if status != SWIM_ALIVE && status != SWIM_SUSPECT {
+		return
+	}
+
+	for _, helper := range helpers {
+		s.n.Send(helper, PingReqInput{Type: "ping_req", Target: target, SyncID: ping.id})
+	}
+	// The helpers need PingTimeout to ping the target, plus a round trip
+	// to us.
+	if len(helpers) > 0 && s.answered(ping, 2*s.config.PingTimeout) {
+		return
+	}
+
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	if swim.Suspect(target) {
+		s.setNeighbors(swim.live())
+	}
+}
+
+// ping sends a ping to target, and returns it. If we are already pinging
+// target, for us or on behalf of another member, and the ping can still get
+// an answer, we return that one instead of sending another. It must be called
+// with neighborsMu held.
+func (s *Server) ping(swim *SwimStrategy, target string) *pendingPing {
+	if ping, ok := s.pings[target]; ok && time.Since(ping.sent) < 3*s.config.PingTimeout {
+		return ping
+	}
+
+	s.msgsMu.RLock()
+	chunks := s.chunks(s.neighborsAcks[target])
+	versions, versionsClock := s.copyVersions(s.sentVersions[target])
+	body := PingInput{
+		SyncInput: SyncInput{
+			Type:     "ping",
+			Version:  s.versionVector(),
+			Promises: s.copyPromises(),
+			Versions: versions,
+		},
+		Updates: swim.Piggyback(target),
+	}
+	s.msgsMu.RUnlock()
+	s.sentVersions[target] = versionsClock
+	body.Membership = s.copyMembership()
+	// We only send the first chunk: the rest goes with the next pings, so
+	// that a node never sends more than MaxSyncSize bytes per period.
+	if len(chunks) > 0 {
+		s.encodeMessages(target, &body.SyncInput, chunks[0])
+	} else {
+		s.encodeMessages(target, &body.SyncInput, nil)
+	}
+
+	s.lastSyncID++
+	body.SyncID = s.lastSyncID
+	ping := &pendingPing{id: body.SyncID, sent: time.Now(), done: make(chan struct{})}
+	s.pings[target] = ping
+	s.n.Send(target, body)
+	return ping
+}
+
+// answered waits up to timeout for an answer to ping, and returns true if it
+// arrived.
+func (s *Server) answered(ping *pendingPing, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ping.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// pong marks the ping with the given id as answered, if we are still waiting
+// for it. It must be called with neighborsMu held.
+func (s *Server) pong(target string, id int) {
+	if ping, ok := s.pings[target]; ok && ping.id == id {
+		close(ping.done)
+		delete(s.pings, target)
+	}
+}
+
+// applyUpdates must be called without holding neighborsMu.
+func (s *Server) applyUpdates(swim *SwimStrategy, updates []SwimUpdate) {
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	changed := false
+	for _, update := range updates {
+		if swim.Apply(update) {
+			changed = true
+		}
+	}
+	if changed {
+		s.setNeighbors(swim.live())
+	}
+}
+
+// The handlers of ping, ping_ok, ping_req and ping_req_ok never return an
+// error, since these messages don't have a msg_id: the library would send the
+// error to the sender as a message that it has no handler for, and its Run
+// would fail. They log the invalid messages and drop them instead.
+func (s *Server) pingHandler(msg maelstrom.Message) error {
+	var inputBody PingInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		log.Printf("invalid ping from %v: %v", msg.Src, err)
+		return nil
+	}
+	swim, ok := s.strategy.(*SwimStrategy)
+	if !ok {
+		log.Printf("ignoring ping from %v: only the swim strategy supports it", msg.Src)
+		return nil
+	}
+
+	s.applyUpdates(swim, inputBody.Updates)
+	syncOutput := s.receiveSync(msg.Src, inputBody.SyncInput)
+	syncOutput.Type = "ping_ok"
+	syncOutput.SyncID = inputBody.SyncID
+
+	s.neighborsMu.Lock()
+	s.msgsMu.RLock()
+	chunks := s.chunks(inputBody.Version)
+	s.msgsMu.RUnlock()
+	updates := swim.Piggyback(msg.Src)
+	s.neighborsMu.Unlock()
+
+	outputBody := PingOutput{
+		SyncOutput: syncOutput,
+		Updates:    updates,
+	}
+	if len(chunks) > 0 {
+		outputBody.Messages = chunks[0]
+	}
+	if err := s.n.Send(msg.Src, outputBody); err != nil {
+		log.Printf("replying to the ping of %v: %v", msg.Src, err)
+	}
+	return nil
+}
+
+// pingOkHandler merges the reply to a ping, even if it arrives too late to
+// count as an answer.
+func (s *Server) pingOkHandler(msg maelstrom.Message) error {
+	var outputBody PingOutput
+	if err := json.Unmarshal(msg.Body, &outputBody); err != nil {
+		log.Printf("invalid ping_ok from %v: %v", msg.Src, err)
+		return nil
+	}
+	swim, ok := s.strategy.(*SwimStrategy)
+	if !ok {
+		log.Printf("ignoring ping_ok from %v: only the swim strategy supports it", msg.Src)
+		return nil
+	}
+
+	messages := s.verifyMessages(msg.Src, outputBody.Messages)
+	s.msgsMu.Lock()
+	added := s.addMessages(messages)
+	s.msgsMu.Unlock()
+	s.pushAll(msg.Src, added)
+	s.receiveSyncOk(msg.Src, outputBody.SyncOutput)
+	s.applyUpdates(swim, outputBody.Updates)
+
+	s.neighborsMu.Lock()
+	s.pong(msg.Src, outputBody.SyncID)
+	s.neighborsMu.Unlock()
+	return nil
+}
+
+// pingReqHandler pings the target on behalf of the sender. If the target
+// doesn't answer we don't reply either, and the sender times out.
+func (s *Server) pingReqHandler(msg maelstrom.Message) error {
+	var inputBody PingReqInput
+	if err := json.Unmarshal(msg.Body, &inputBody); err != nil {
+		log.Printf("invalid ping_req from %v: %v", msg.Src, err)
+		return nil
+	}
+	swim, ok := s.strategy.(*SwimStrategy)
+	if !ok {
+		log.Printf("ignoring ping_req from %v: only the swim strategy supports it", msg.Src)
+		return nil
+	}
+
+	s.neighborsMu.Lock()
+	ping := s.ping(swim, inputBody.Target)
+	s.neighborsMu.Unlock()
+	if !s.answered(ping, s.config.PingTimeout) {
+		s.neighborsMu.Lock()
+		s.lost(inputBody.Target)
+		s.neighborsMu.Unlock()
+		return nil
+	}
+
+	outputBody := PingReqOutput{
+		Type:   "ping_req_ok",
+		Target: inputBody.Target,
+		SyncID: inputBody.SyncID,
+	}
+	if err := s.n.Send(msg.Src, outputBody); err != nil {
+		log.Printf("replying to the ping_req of %v: %v", msg.Src, err)
+	}
+	return nil
+}
+
+func (s *Server) pingReqOkHandler(msg maelstrom.Message) error {
+	var outputBody PingReqOutput
+	if err := json.Unmarshal(msg.Body, &outputBody); err != nil {
+		log.Printf("invalid ping_req_ok from %v: %v", msg.Src, err)
+		return nil
+	}
+	s.neighborsMu.Lock()
+	s.pong(outputBody.Target, outputBody.SyncID)
+	s.neighborsMu.Unlock()
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// notifyNewMessages must be called with msgsMu held.
+func (s *Server) notifyNewMessages(count int) {
+	s.pending += count
+	select {
+	case s.newMsgs <- struct{}{}:
+	default:
+	}
+}
+
+// syncLoop runs a sync round every SyncTimeout while there are new messages
+// to propagate. When a round has nothing to send, we double the interval up
+// to MaxSyncTimeout, and we go back to SyncTimeout as soon as a new message
+// arrives. If BatchSize new messages arrive before the end of the interval,
+// we sync right away.
+func (s *Server) syncLoop(done <-chan struct{}) {
+	interval := s.config.SyncTimeout
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if s.syncRound() {
+				interval = s.config.SyncTimeout
+			} else {
+				interval *= 2
+				if interval > s.config.MaxSyncTimeout {
+					interval = s.config.MaxSyncTimeout
+				}
+			}
+			timer.Reset(interval)
+
+		case <-s.newMsgs:
+			s.msgsMu.RLock()
+			pending := s.pending
+			s.msgsMu.RUnlock()
+			if pending >= s.config.BatchSize {
+				s.syncRound()
+			} else if interval == s.config.SyncTimeout {
+				continue
+			}
+			interval = s.config.SyncTimeout
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(interval)
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// syncRound calls the sync rpc on the neighbors chosen by the strategy,
+// sending them the messages that are not covered by their version vectors.
+// When a neighbor replies, we replace our copy of its version vector instead
+// of merging them: in eager mode our copy can be ahead of the real one, if a
+// push got lost, and the reply is how we find out.
+//
+// We skip the neighbors that have nothing to receive (no messages and no new
+// promises), unless we haven't heard from them for MaxSyncTimeout: in that
+// case we send them an empty sync, so that we keep exchanging version vectors
+// and we notice if they fail. syncRound returns true if it sent any message
+// or promise, or if some are waiting for a neighbor to answer.
+//
+// We only keep one sync in flight for every neighbor: if a neighbor hasn't
+// answered the previous one yet (it may be slow, or on the other side of a
+// partition), we skip it, and the messages wait for the next round together
+// with the ones that arrive in the meantime, instead of sending the same
+// messages again at every round. For the same reason we only send the first
+// chunk, and the next one goes out once the neighbor has acknowledged it.
+func (s *Server) syncRound() bool {
+	s.checkFailures()
+	s.graftMissing()
+
+	s.msgsMu.Lock()
+	s.pending = 0
+	s.msgsMu.Unlock()
+
+	sent := false
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	for _, neighbor := range s.neighbors {
+		if s.suspected[neighbor] && time.Since(s.lastProbe[neighbor]) >= s.config.MaxSyncTimeout {
+			s.lastProbe[neighbor] = time.Now()
+			s.msgsMu.RLock()
+			version := s.versionVector()
+			s.msgsMu.RUnlock()
+			s.sync(neighbor, SyncInput{Type: "sync", Version: version})
+		}
+	}
+	for _, neighbor := range s.strategy.Targets(s.activeNeighbors()) {
+		if _, ok := s.inFlight[neighbor]; ok && !s.busy(neighbor) {
+			// The last sync or its reply got lost, so the neighbor may
+			// have missed what it carried.
+			s.lost(neighbor)
+		}
+		s.msgsMu.RLock()
+		chunks := s.chunks(s.neighborsAcks[neighbor])
+		version := s.versionVector()
+		promises := s.copyPromises()
+		promisesVersion := s.promisesVersion
+		versions, versionsClock := s.copyVersions(s.sentVersions[neighbor])
+		s.msgsMu.RUnlock()
+
+		newPromises := promises != nil && s.sentPromises[neighbor] != promisesVersion
+		membership := s.copyMembership()
+		newMembership := membership != nil && s.sentMembership[neighbor] != membership.Version
+		if len(chunks) > 0 || newPromises || newMembership {
+			sent = true
+		} else if time.Since(s.lastSeen[neighbor]) < s.config.MaxSyncTimeout {
+			continue
+		}
+		if s.busy(neighbor) {
+			continue
+		}
+		s.sentPromises[neighbor] = promisesVersion
+		s.sentMembership[neighbor] = s.membership.Version
+		s.sentVersions[neighbor] = versionsClock
+		// With plumtree the syncs only announce our version vector, and
+		// the neighbors graft the link if they miss some messages.
+		if _, ok := s.strategy.(*PlumtreeStrategy); ok || len(chunks) == 0 {
+			chunks = []map[string][]Entry{{}}
+		}
+
+		body := SyncInput{
+			Type:       "sync",
+			Version:    version,
+			Promises:   promises,
+			Versions:   versions,
+			Membership: membership,
+			Detour:     !contains(s.neighbors, neighbor),
+		}
+		s.encodeMessages(neighbor, &body, chunks[0])
+		s.sync(neighbor, body)
+	}
+	return sent
+}
+
+// chunks returns the messages that are not covered by acks, split into groups
+// of at most MaxSyncSize bytes. It must be called with msgsMu held.
+func (s *Server) chunks(acks VersionVector) []map[string][]Entry {
+	res := []map[string][]Entry{}
+	chunk, size := map[string][]Entry{}, 0
+	for origin, log := range s.logs {
+		for _, entry := range log.After(acks[origin]) {
+			if size+len(entry.Data) > s.config.MaxSyncSize && size > 0 {
+				res = append(res, chunk)
+				chunk, size = map[string][]Entry{}, 0
+			}
+			chunk[origin] = append(chunk[origin], entry)
+			size += len(entry.Data)
+		}
+	}
+	if size > 0 {
+		res = append(res, chunk)
+	}
+	return res
+}
+
+// queued returns the number of messages that are not covered by acks. It must
+// be called with msgsMu held.
+func (s *Server) queued(acks VersionVector) int {
+	res := 0
+	for origin, log := range s.logs {
+		res += len(log.After(acks[origin]))
+	}
+	return res
+}
+
+// lost forgets what we sent to neighbor, so that we send it again. It must be
+// called with neighborsMu held.
+func (s *Server) lost(neighbor string) {
+	delete(s.sentPromises, neighbor)
+	delete(s.sentMembership, neighbor)
+	delete(s.sentVersions, neighbor)
+}
+
+type syncInFlight struct {
+	id   int
+	sent time.Time
+}
+
+// busy returns true if neighbor hasn't answered our last sync, and we haven't
+// given up on it yet. It must be called with neighborsMu held.
+func (s *Server) busy(neighbor string) bool {
+	sync, ok := s.inFlight[neighbor]
+	return ok && time.Since(sync.sent) < s.config.SyncRPCTimeout
+}
+
+// sync sends a sync to neighbor, unless it is busy, and returns true if it
+// sent it. We don't use an rpc, because the maelstrom library never removes
+// the callbacks of the rpcs that aren't answered, and a neighbor on the other
+// side of a partition would leave one behind every SyncRPCTimeout. Without a
+// msg_id the reply comes back as a sync_ok message, that syncOkHandler merges
+// whenever it arrives. It must be called with neighborsMu held.
+func (s *Server) sync(neighbor string, body SyncInput) bool {
+	if s.busy(neighbor) {
+		return false
+	}
+	s.lastSyncID++
+	body.SyncID = s.lastSyncID
+	s.inFlight[neighbor] = syncInFlight{id: body.SyncID, sent: time.Now()}
+	s.sent(neighbor)
+	s.n.Send(neighbor, body)
+	return true
+}
+
+// syncOkHandler merges the reply to a sync, even if it answers a sync that we
+// considered lost, but only the reply to the sync in flight lets us send the
+// next one. Like syncHandler, it never returns an error.
+func (s *Server) syncOkHandler(msg maelstrom.Message) error {
+	var outputBody SyncOutput
+	if err := json.Unmarshal(msg.Body, &outputBody); err != nil {
+		log.Printf("invalid sync_ok from %v: %v", msg.Src, err)
+		return nil
+	}
+	s.neighborsMu.Lock()
+	if s.inFlight[msg.Src].id == outputBody.SyncID {
+		delete(s.inFlight, msg.Src)
+	}
+	s.neighborsMu.Unlock()
+
+	// Only the detours reply with messages.
+	if outputBody.Messages != nil {
+		messages := s.verifyMessages(msg.Src, outputBody.Messages)
+		s.msgsMu.Lock()
+		added := s.addMessages(messages)
+		s.msgsMu.Unlock()
+		s.pushAll(msg.Src, added)
+	}
+	s.receiveSyncOk(msg.Src, outputBody)
+	return nil
+}
+
+// receiveSyncOk merges the state that a neighbor sent us in reply to a sync.
+func (s *Server) receiveSyncOk(neighbor string, outputBody SyncOutput) {
+	if outputBody.Promises != nil || outputBody.Versions != nil {
+		s.msgsMu.Lock()
+		s.mergePromises(outputBody.Promises)
+		s.mergeVersions(outputBody.Versions)
+		s.msgsMu.Unlock()
+	}
+	s.neighborsMu.Lock()
+	defer s.neighborsMu.Unlock()
+	if outputBody.Membership != nil {
+		s.setMembership(*outputBody.Membership)
+	}
+	s.setAcks(neighbor, outputBody.Version)
+	s.setEncodings(neighbor, outputBody.Encodings)
+	s.announce(neighbor, outputBody.Version)
+	s.heard(neighbor)
+}